@@ -3,18 +3,76 @@ package gexpect
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"regexp"
+	"regexp/syntax"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
 )
 
 var (
-	ErrEmptySearch = errors.New("empty search string")
+	ErrEmptySearch   = errors.New("empty search string")
+	ErrNegativeCount = errors.New("negative byte count")
+	ErrInvalidUTF8   = errors.New("invalid UTF-8 in output")
+	ErrAborted       = errors.New("search aborted")
+	ErrLineTooLong   = errors.New("line too long")
+
+	// ErrWriteAfterClose matches, with errors.Is, the *SendError of a
+	// send to a child that has closed its input or exited, the way io.EOF
+	// tells that its output has ended.
+	ErrWriteAfterClose = errors.New("write to a child that has gone away")
 )
 
+// TimeoutError is returned when a call gives up waiting for a pattern,
+// as opposed to the output ending without a match. Output holds whatever
+// had been read while waiting.
+type TimeoutError struct {
+	Pattern string
+	Timeout time.Duration
+	Output  string
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Expect timed out after %v waiting for '%v'.\nOutput:\n%s", e.Timeout, e.Pattern, e.Output)
+}
+
+// TruncatedError is returned by regex searches with SetReportTruncated on
+// when the output ended in the middle of a possible match. Tail is the
+// unfinished part of the output.
+type TruncatedError struct {
+	Pattern string
+	Tail    string
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("Output ended partway through a match of '%v': %q", e.Pattern, e.Tail)
+}
+
+// CanceledError is returned when the context of a search is done before a
+// match. Output holds whatever had been read while waiting, which is also
+// left for the next call.
+type CanceledError struct {
+	Pattern string
+	Output  string
+	Err     error
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("Expect for '%v' canceled: %v\nOutput:\n%s", e.Pattern, e.Err, e.Output)
+}
+
 func NewExpectIO(in io.Reader, out io.Writer) *ExpectIO {
 	wrapper := new(ExpectIO)
 
@@ -22,28 +80,82 @@ func NewExpectIO(in io.Reader, out io.Writer) *ExpectIO {
 
 	wrapper.buf = new(buffer)
 
-	wrapper.buf.rw = bufio.NewReadWriter(bufio.NewReader(in), bufio.NewWriter(out))
+	wrapper.buf.attach(in, out)
 
 	return wrapper
 }
 
+// NewExpectIOReplay returns an ExpectIO that plays back a recorded session,
+// e.g. one captured with SetMirror, to test automation without the real
+// device. The transcript is served as the child's output as fast as it is
+// read; recorded timing is not reproduced. Anything sent is discarded.
+func NewExpectIOReplay(transcript io.Reader) *ExpectIO {
+	return NewExpectIO(transcript, ioutil.Discard)
+}
+
+// ExpectIO matches against the output of a child. All of its methods read
+// through one shared buffer: whatever a call reads beyond what it consumes
+// is put back in front of the remaining output, so that calls such as
+// ReadLine, Expect, Peek and ExpectRegex can be interleaved freely without
+// losing or repeating any bytes. Output already buffered is searched before
+// anything more is read, so a match that is at hand never blocks.
 type ExpectIO struct {
-	buf          *buffer
-	outputBuffer []byte
+	buf             *buffer
+	outputBuffer    []byte
+	verboseErrors   bool
+	maxBufferSize   int
+	reportTruncated bool
+	matchWholeLine  bool
+	missHook        func(buffered string) bool // of ExpectRegexWithRetryHook
+	ignoreEcho      bool
+	echoLeft        int    // bytes of echo still ahead for SetIgnoreEcho
+	sinceLast       string // for SinceLastMatch
+	maxLineLength   int
+	fromBuffer      bool // for LastMatchFromBuffer
+	advanced        int  // bytes consumed by the last regexFind match
 }
 
 func (expect *ExpectIO) AsyncInteractChannels() (send chan string, receive chan string) {
+	return expect.AsyncInteractChannelsContext(context.Background())
+}
+
+// AsyncInteractChannelsContext is like AsyncInteractChannels, but stops
+// when ctx is done: both goroutines exit and receive is closed. A read of
+// the child's output still under way then completes in the background, and
+// what it reads is kept for later calls.
+func (expect *ExpectIO) AsyncInteractChannelsContext(ctx context.Context) (send chan string, receive chan string) {
 	receive = make(chan string)
 	send = make(chan string)
+	// Only the reading goroutine uses receive, so that it can close it.
+	sendErr := make(chan string, 1)
 
 	go func() {
+		defer close(receive)
+		deliver := func(str string) bool {
+			select {
+			case receive <- str:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
 		for {
+			if !expect.buf.hasLine() {
+				select {
+				case r := <-expect.buf.readAsync():
+					expect.buf.finishAsync(r)
+				case msg := <-sendErr:
+					deliver(msg)
+					return
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
 			str, err := expect.ReadLine()
-			if err != nil {
-				close(receive)
+			if err != nil || !deliver(str) {
 				return
 			}
-			receive <- str
 		}
 	}()
 
@@ -51,16 +163,15 @@ func (expect *ExpectIO) AsyncInteractChannels() (send chan string, receive chan
 		for {
 			select {
 			case sendCommand, exists := <-send:
-				{
-					if !exists {
-						return
-					}
-					err := expect.Send(sendCommand)
-					if err != nil {
-						receive <- "gexpect Error: " + err.Error()
-						return
-					}
+				if !exists {
+					return
 				}
+				if err := expect.Send(sendCommand); err != nil {
+					sendErr <- "gexpect Error: " + err.Error()
+					return
+				}
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
@@ -68,8 +179,16 @@ func (expect *ExpectIO) AsyncInteractChannels() (send chan string, receive chan
 	return
 }
 
+// ExpectRegex reports whether regex matches the output. Everything up to
+// the end of the match is consumed; output read past it is kept for the
+// next call, so that consecutive calls pick up where the last one stopped.
 func (expect *ExpectIO) ExpectRegex(regex string) (bool, error) {
-	return regexp.MatchReader(regex, expect.buf)
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return false, err
+	}
+	pairs, _, _ := expect.expectRegexFindIndex(re)
+	return pairs != nil, nil
 }
 
 func (expect *ExpectIO) expectRegexFind(regex string, output bool) ([]string, string, error) {
@@ -77,45 +196,382 @@ func (expect *ExpectIO) expectRegexFind(regex string, output bool) ([]string, st
 	if err != nil {
 		return nil, "", err
 	}
-	expect.buf.StartCollecting()
-	pairs := re.FindReaderSubmatchIndex(expect.buf)
-	stringIndexedInto := expect.buf.StopCollecting()
-	l := len(pairs)
-	numPairs := l / 2
-	result := make([]string, numPairs)
-	for i := 0; i < numPairs; i += 1 {
-		result[i] = stringIndexedInto[pairs[i*2]:pairs[i*2+1]]
+	pairs, stringIndexedInto, err := expect.expectRegexFindIndex(re)
+	return submatches(stringIndexedInto, pairs), stringIndexedInto, err
+}
+
+// expectRegexFindIndex reads until re matches and returns the submatch
+// index pairs into the returned output. Anything read past the end of the
+// match is put back for the next call.
+func (expect *ExpectIO) expectRegexFindIndex(re *regexp.Regexp) ([]int, string, error) {
+	return expect.regexFind(re, expect.maxBufferSize, false, nil)
+}
+
+// regexFind searches the output for re, matching again after each read.
+// This way a match at the very end of the output, such as a prompt, is
+// found without waiting for more, and one early in a large backlog of
+// output at hand is found without going through all of it. A match that
+// runs to the end of what has been read is only taken once no more output
+// is at hand, since it might go on in that output. Only the
+// last max bytes are kept for matching if max is positive. An anchored
+// search gives up as soon as the output can't match anymore. Once done is
+// closed the search stops with errCanceled, and the output read so far is
+// returned and put back.
+func (expect *ExpectIO) regexFind(re *regexp.Regexp, max int, anchored bool, done <-chan struct{}) ([]int, string, error) {
+	expect.buf.StartCollecting(max)
+	size := minReadSize
+	if max > 0 && max < size {
+		size = max
 	}
-	// convert indexes to strings
+	chunk := make([]byte, size)
+	// Matches starting within echo to ignore are skipped.
+	echo := expect.echoLeft
+	expect.echoLeft = 0
+	reads := expect.buf.readCount()
+	total := 0
+	for {
+		n, err := expect.buf.readOrDone(chunk, done)
+		total += n
+		if err == errCanceled {
+			output := expect.buf.StopCollecting()
+			expect.buf.PutBack([]byte(output))
+			expect.echoLeft = echo
+			expect.buf.debugf("debug", "search for %q gave up after %d bytes", re, len(output))
+			return nil, output, err
+		}
+		if n == 0 && err == nil {
+			continue
+		}
+		data := expect.buf.collectedBytes()
+		if expect.buf.debugLog != nil {
+			expect.buf.debugf("trace", "matching %q against %d bytes", re, len(data))
+		}
+		pairs := findAfter(re, data, echo)
+		more := err == nil && expect.buf.buffered() > 0 && (max <= 0 || len(data) < max)
+		if pairs != nil && (pairs[1] < len(data) || !more) {
+			expect.buf.debugf("debug", "matched %q at offset %d", re, pairs[0])
+			expect.buf.StopCollecting()
+			// The number in pairs[1] is an index of a first
+			// character outside the whole match
+			expect.buf.PutBack(data[pairs[1]:])
+			matched := data[:pairs[1]]
+			rest := expect.restOfLine(matched)
+			out := string(matched) + string(rest)
+			expect.advanced = total - (len(data) - pairs[1]) + len(rest)
+			expect.sinceLast = out
+			expect.fromBuffer = expect.buf.readCount() == reads
+			return pairs, out, nil
+		}
+		if pairs == nil && anchored && partialMatchStart(re, data) != 0 {
+			err = errNoMatch
+		}
+		if err != nil {
+			expect.buf.debugf("debug", "no match for %q: %v", re, err)
+			output := expect.buf.StopCollecting()
+			if anchored {
+				expect.buf.PutBack([]byte(output))
+				expect.echoLeft = echo
+			}
+			if expect.reportTruncated && err != errNoMatch {
+				if start := partialMatchStart(re, data); start >= 0 {
+					return nil, output, &TruncatedError{Pattern: re.String(), Tail: output[start:]}
+				}
+			}
+			notFound := fmt.Errorf("ExpectRegex didn't find regex '%v'.", re)
+			if expect.verboseErrors {
+				notFound = fmt.Errorf("%v%s", notFound, notFoundDetails(re, output))
+			}
+			return nil, output, expect.withScrollback(notFound)
+		}
+		if pairs == nil && expect.missHook != nil && !expect.missHook(string(data)) {
+			output := expect.buf.StopCollecting()
+			expect.buf.PutBack([]byte(output))
+			expect.echoLeft = echo
+			expect.buf.debugf("debug", "search for %q aborted by its hook", re)
+			return nil, output, ErrAborted
+		}
+		// Old output is only dropped after a failed match, so a match
+		// straddling two reads is still seen whole.
+		if pairs == nil {
+			expect.buf.trimCollection()
+			if echo > 0 {
+				echo -= len(data) - expect.buf.collectedLen()
+			}
+		}
+		// Read more at a time as the output grows, so that it isn't
+		// matched against over and over when plenty is available.
+		if len(data) > len(chunk) && (max <= 0 || len(data) <= max) {
+			chunk = make([]byte, len(data))
+		}
+	}
+}
 
-	if len(result) == 0 {
-		err = fmt.Errorf("ExpectRegex didn't find regex '%v'.", regex)
-	} else {
-		// The number in pairs[1] is an index of a first
-		// character outside the whole match
-		putBackIdx := pairs[1]
-		if len(stringIndexedInto) > putBackIdx {
-			stringToPutBack := stringIndexedInto[putBackIdx:]
-			stringIndexedInto = stringIndexedInto[:putBackIdx]
-			expect.buf.PutBack([]byte(stringToPutBack))
+// findAfter is re.FindSubmatchIndex for a match that starts at skip or
+// later in data.
+func findAfter(re *regexp.Regexp, data []byte, skip int) []int {
+	if skip <= 0 {
+		return re.FindSubmatchIndex(data)
+	}
+	if skip > len(data) {
+		return nil
+	}
+	pairs := re.FindSubmatchIndex(data[skip:])
+	for i := range pairs {
+		if pairs[i] >= 0 {
+			pairs[i] += skip
 		}
 	}
-	return result, stringIndexedInto, err
+	return pairs
 }
 
-func (expect *ExpectIO) expectTimeoutRegexFind(regex string, timeout time.Duration) (result []string, out string, err error) {
-	t := make(chan bool)
-	go func() {
-		result, out, err = expect.ExpectRegexFindWithOutput(regex)
-		t <- false
-	}()
+// minReadSize is the least regexFind reads from the output at a time.
+const minReadSize = 4096
+
+var (
+	errNoMatch  = errors.New("no match")
+	errCanceled = errors.New("canceled")
+)
+
+// verboseTail is how much of the output verbose errors show.
+const verboseTail = 256
+
+// notFoundDetails describes where the search for re in output went wrong:
+// the end of the output, and how much of the pattern could be matched.
+func notFoundDetails(re *regexp.Regexp, output string) string {
+	tail := output
+	if len(tail) > verboseTail {
+		tail = "..." + tail[len(tail)-verboseTail:]
+	}
+	details := fmt.Sprintf("\nOutput tail:\n%s", tail)
+	if prefix, at := longestMatchingPrefix(re, output); prefix != "" {
+		details += fmt.Sprintf("\nLongest matching prefix of the regex: '%s' at offset %d", prefix, at)
+	}
+	return details
+}
+
+// longestMatchingPrefix finds the longest leading part of re that matches
+// in s, splitting re at the top level and literals into single runes.
+func longestMatchingPrefix(re *regexp.Regexp, s string) (string, int) {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return "", -1
+	}
+	parts := []*syntax.Regexp{parsed}
+	if parsed.Op == syntax.OpConcat {
+		parts = parsed.Sub
+	}
+	var units []*syntax.Regexp
+	for _, part := range parts {
+		if part.Op != syntax.OpLiteral {
+			units = append(units, part)
+			continue
+		}
+		for _, r := range part.Rune {
+			units = append(units, &syntax.Regexp{Op: syntax.OpLiteral, Flags: part.Flags, Rune: []rune{r}})
+		}
+	}
+	for k := len(units) - 1; k > 0; k-- {
+		prefix := &syntax.Regexp{Op: syntax.OpConcat, Flags: parsed.Flags, Sub: units[:k]}
+		prefixRe, err := regexp.Compile(prefix.String())
+		if err != nil {
+			continue
+		}
+		if loc := prefixRe.FindStringIndex(s); loc != nil {
+			return prefix.String(), loc[0]
+		}
+	}
+	return "", -1
+}
+
+// partialMatchStart returns where the earliest match of re would begin
+// that is still under way at the end of data, that is, the start of the
+// part of data that more output could complete into a match. It is -1 if
+// there is none. The program of re is run by hand, as package regexp has
+// no way to tell an unfinished match from a failed one.
+func partialMatchStart(re *regexp.Regexp, data []byte) int {
+	prog, err := compileProg(re)
+	if err != nil {
+		return -1
+	}
+	return partialMatch(prog, data)
+}
+
+func compileProg(re *regexp.Regexp) (*syntax.Prog, error) {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	return syntax.Compile(parsed.Simplify())
+}
+
+// partialMatch is partialMatchStart for the compiled program of a regexp.
+func partialMatch(prog *syntax.Prog, data []byte) int {
+	type thread struct {
+		pc    uint32
+		start int
+	}
+	seen := make([]bool, len(prog.Inst))
+	// add follows the instructions from pc that consume no input and
+	// queues the ones that do. At the end of data what follows is still
+	// unknown, so assertions are given the benefit of the doubt.
+	var add func(list []thread, pc uint32, start int, context syntax.EmptyOp, atEnd bool) []thread
+	add = func(list []thread, pc uint32, start int, context syntax.EmptyOp, atEnd bool) []thread {
+		if seen[pc] {
+			return list
+		}
+		seen[pc] = true
+		inst := &prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			list = add(list, inst.Out, start, context, atEnd)
+			list = add(list, inst.Arg, start, context, atEnd)
+		case syntax.InstCapture, syntax.InstNop:
+			list = add(list, inst.Out, start, context, atEnd)
+		case syntax.InstEmptyWidth:
+			if atEnd || syntax.EmptyOp(inst.Arg)&^context == 0 {
+				list = add(list, inst.Out, start, context, atEnd)
+			}
+		case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			list = append(list, thread{pc, start})
+		}
+		return list
+	}
+	var threads, next []thread
+	prev := rune(-1)
+	for pos := 0; pos < len(data); {
+		r, size := utf8.DecodeRune(data[pos:])
+		for i := range seen {
+			seen[i] = false
+		}
+		// Threads are kept in order of their start, so that the
+		// earliest one wins whenever two reach the same instruction.
+		context := syntax.EmptyOpContext(prev, r)
+		current := threads[:0:0]
+		for _, t := range threads {
+			current = add(current, t.pc, t.start, context, false)
+		}
+		current = add(current, uint32(prog.Start), pos, context, false)
+		next = next[:0]
+		for _, t := range current {
+			if prog.Inst[t.pc].MatchRune(r) {
+				next = append(next, thread{prog.Inst[t.pc].Out, t.start})
+			}
+		}
+		threads, next = next, threads
+		prev = r
+		pos += size
+	}
+	for i := range seen {
+		seen[i] = false
+	}
+	start := -1
+	for _, t := range threads {
+		if alive := add(nil, t.pc, t.start, 0, true); len(alive) > 0 && (start < 0 || t.start < start) {
+			start = t.start
+		}
+	}
+	return start
+}
+
+// alternation is a set of patterns compiled into a single regexp that
+// matches whichever of them appears first.
+type alternation struct {
+	re *regexp.Regexp
+	// groups[i] is the index of the submatch holding the match of
+	// patterns[i].
+	groups []int
+}
+
+func compileAlternation(patterns []string) (*alternation, error) {
+	groups := make([]int, len(patterns))
+	parts := make([]string, len(patterns))
+	next := 1
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		groups[i] = next
+		next += 1 + re.NumSubexp()
+		parts[i] = "(" + pattern + ")"
+	}
+	re, err := regexp.Compile(strings.Join(parts, "|"))
+	if err != nil {
+		return nil, err
+	}
+	return &alternation{re, groups}, nil
+}
+
+// which returns the index of the pattern that matched.
+func (a *alternation) which(pairs []int) int {
+	for i, group := range a.groups {
+		if pairs[group*2] >= 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// submatches returns the match of pattern i followed by its own groups.
+func (a *alternation) submatches(s string, pairs []int, i int) []string {
+	end := len(pairs) / 2
+	if i+1 < len(a.groups) {
+		end = a.groups[i+1]
+	}
+	return submatches(s, pairs[a.groups[i]*2:end*2])
+}
+
+type regexFindResult struct {
+	pairs []int
+	out   string
+	err   error
+}
+
+// goRegexFindIndex runs expectRegexFindIndex in the background until done
+// is closed, so that callers can wait on several searches at once.
+func (expect *ExpectIO) goRegexFindIndex(re *regexp.Regexp, done <-chan struct{}) <-chan regexFindResult {
+	result := make(chan regexFindResult, 1)
 	go func() {
-		time.Sleep(timeout)
-		err = fmt.Errorf("ExpectRegex timed out after %v finding '%v'.\nOutput:\n%s", timeout, regex, expect.Collect())
-		t <- true
+		pairs, out, err := expect.regexFind(re, expect.maxBufferSize, false, done)
+		result <- regexFindResult{pairs, out, err}
 	}()
-	<-t
-	return result, out, err
+	return result
+}
+
+// closeAfter returns a channel that is closed once d has passed, and a
+// function that stops the timer.
+func closeAfter(d time.Duration) (<-chan struct{}, func() bool) {
+	done := make(chan struct{})
+	timer := time.AfterFunc(d, func() { close(done) })
+	return done, timer.Stop
+}
+
+// submatches converts index pairs into strings. Groups that did not
+// participate in the match are left empty.
+func submatches(s string, pairs []int) []string {
+	result := make([]string, len(pairs)/2)
+	for i := range result {
+		if pairs[i*2] >= 0 {
+			result[i] = s[pairs[i*2]:pairs[i*2+1]]
+		}
+	}
+	return result
+}
+
+// expectTimeoutRegexFind gives up after timeout, leaving the output read
+// meanwhile for the next call.
+func (expect *ExpectIO) expectTimeoutRegexFind(regex string, timeout time.Duration) ([]string, string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, "", err
+	}
+	done, stop := closeAfter(timeout)
+	defer stop()
+	pairs, out, err := expect.regexFind(re, expect.maxBufferSize, false, done)
+	if err == errCanceled {
+		return nil, out, fmt.Errorf("ExpectRegex timed out after %v finding '%v'.\nOutput:\n%s", timeout, regex, out)
+	}
+	return submatches(out, pairs), out, err
 }
 
 func (expect *ExpectIO) ExpectRegexFind(regex string) ([]string, error) {
@@ -123,15 +579,643 @@ func (expect *ExpectIO) ExpectRegexFind(regex string) ([]string, error) {
 	return result, err
 }
 
+// ExpectRegexFindContext is like ExpectRegexFindWithOutput, but gives up
+// once ctx is done with a *CanceledError holding the partial output. That
+// output isn't consumed: the next call sees it again.
+func (expect *ExpectIO) ExpectRegexFindContext(ctx context.Context, regex string) ([]string, string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, "", err
+	}
+	pairs, out, err := expect.regexFind(re, expect.maxBufferSize, false, ctx.Done())
+	if err == errCanceled {
+		return nil, out, &CanceledError{Pattern: regex, Output: out, Err: ctx.Err()}
+	}
+	return submatches(out, pairs), out, err
+}
+
 func (expect *ExpectIO) ExpectTimeoutRegexFind(regex string, timeout time.Duration) ([]string, error) {
 	result, _, err := expect.expectTimeoutRegexFind(regex, timeout)
 	return result, err
 }
 
+// ExpectRegexFindOrDefault is for output that may or may not be there: it
+// returns the groups of regex and true if it matches within timeout, and
+// nil and false if it doesn't, the output ends first or regex is invalid.
+// On timeout the output read is left for the next call.
+func (expect *ExpectIO) ExpectRegexFindOrDefault(regex string, timeout time.Duration) ([]string, bool) {
+	groups, _, err := expect.expectTimeoutRegexFind(regex, timeout)
+	if err != nil {
+		return nil, false
+	}
+	return groups, true
+}
+
+// ExpectRegexFindPos is like ExpectRegexFind, but also returns the number
+// of bytes consumed, the output skipped before the match along with the
+// match itself, for callers that keep track of offsets in the stream. This
+// includes output dropped under SetMaxBufferSize. On error it is 0.
+func (expect *ExpectIO) ExpectRegexFindPos(pattern string) (groups []string, consumed int, err error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, 0, err
+	}
+	pairs, out, err := expect.expectRegexFindIndex(re)
+	if err != nil {
+		return nil, 0, err
+	}
+	return submatches(out, pairs), expect.advanced, nil
+}
+
+// ExpectRegexFindBuffered matches pattern against the output already at
+// hand, never reading or waiting for more, so that an event loop can poll
+// for it. It returns the groups and true on a match, with the output up to
+// its end consumed, and nil and false if there is none or pattern is
+// invalid, with everything left as it was. A background read that has
+// completed counts as at hand. Note that a match running to the end of
+// the output at hand may go on in output still to come.
+func (expect *ExpectIO) ExpectRegexFindBuffered(pattern string) ([]string, bool) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, false
+	}
+	select {
+	case r := <-expect.buf.inflight:
+		expect.buf.finishAsync(r)
+	default:
+	}
+	data := make([]byte, expect.buf.buffered())
+	n, _ := io.ReadFull(expect.buf, data)
+	data = data[:n]
+	pairs := re.FindSubmatchIndex(data)
+	if pairs == nil {
+		expect.buf.PutBack(data)
+		return nil, false
+	}
+	expect.buf.PutBack(data[pairs[1]:])
+	matched := data[:pairs[1]]
+	out := string(matched) + string(expect.restOfLine(matched))
+	expect.sinceLast = out
+	expect.fromBuffer = true
+	return submatches(out, pairs), true
+}
+
+// WaitReadable waits up to d for output to read and reports whether there
+// is any, without consuming it, e.g. to poll a child from an event loop.
+// Output put back or read ahead counts right away. Once the output has
+// ended with nothing left to read it returns false and the error that
+// ended it. A read still under way after d keeps its output for later.
+func (expect *ExpectIO) WaitReadable(d time.Duration) (bool, error) {
+	done, stop := closeAfter(d)
+	defer stop()
+	for expect.buf.buffered() == 0 {
+		if expect.buf.readErr != nil {
+			return false, expect.buf.readErr
+		}
+		select {
+		case r := <-expect.buf.readAsync():
+			expect.buf.finishAsync(r)
+		case <-done:
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ExpectRegexFindLast waits for regex like ExpectRegexFind, but then goes
+// on through the output at hand and returns the groups of the last match
+// in it, e.g. to sync to the newest of several prompts that arrived in one
+// burst. Everything up to the end of that match is consumed. Matches don't
+// overlap, and output still to come is not waited for.
+func (expect *ExpectIO) ExpectRegexFindLast(regex string) ([]string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, err
+	}
+	pairs, out, err := expect.expectRegexFindIndex(re)
+	if err != nil {
+		return nil, err
+	}
+	groups := submatches(out, pairs)
+	for expect.buf.buffered() > 0 {
+		data := make([]byte, expect.buf.buffered())
+		n, _ := io.ReadFull(expect.buf, data)
+		data = data[:n]
+		all := re.FindAllSubmatchIndex(data, -1)
+		if all == nil || all[len(all)-1][1] == 0 {
+			expect.buf.PutBack(data)
+			break
+		}
+		last := all[len(all)-1]
+		expect.buf.PutBack(data[last[1]:])
+		matched := data[:last[1]]
+		out := string(matched) + string(expect.restOfLine(matched))
+		expect.sinceLast += out
+		groups = submatches(out, last)
+	}
+	return groups, nil
+}
+
+// Mark is a position in the output, taken with (*ExpectIO).Mark.
+type Mark struct {
+	pos int64
+}
+
+// Mark returns the current end of the output received, so that a later
+// ExpectRegexFindAfter can ignore everything before it, e.g. an old prompt
+// still buffered from a previous command.
+func (expect *ExpectIO) Mark() Mark {
+	expect.buf.mu.Lock()
+	defer expect.buf.mu.Unlock()
+	return Mark{expect.buf.received}
+}
+
+// ExpectRegexFindAfter is like ExpectRegexFind, but only considers output
+// received after mark: whatever came before it and hasn't been consumed yet
+// is discarded first. Output put back with Unread counts as received
+// before any mark.
+func (expect *ExpectIO) ExpectRegexFindAfter(regex string, mark Mark) ([]string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, err
+	}
+	expect.buf.settle()
+	expect.buf.mu.Lock()
+	consumed := expect.buf.received - int64(expect.buf.buffered())
+	expect.buf.mu.Unlock()
+	if stale := mark.pos - consumed; stale > 0 {
+		// All of it is at hand, so this doesn't block.
+		if _, err := io.CopyN(ioutil.Discard, expect.buf, stale); err != nil {
+			return nil, err
+		}
+	}
+	pairs, out, err := expect.expectRegexFindIndex(re)
+	return submatches(out, pairs), err
+}
+
+// ExpectRegexFindNamedDefault returns the named groups of the first match of
+// regex. Optional groups that did not take part in the match are filled in
+// from defaults, so they can be told apart from groups that matched empty.
+func (expect *ExpectIO) ExpectRegexFindNamedDefault(regex string, defaults map[string]string) (map[string]string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, err
+	}
+	pairs, out, err := expect.expectRegexFindIndex(re)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string)
+	for i, name := range re.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if pairs[i*2] >= 0 {
+			result[name] = out[pairs[i*2]:pairs[i*2+1]]
+		} else {
+			result[name] = defaults[name]
+		}
+	}
+	return result, nil
+}
+
+// ExpectRetry waits up to timeout for regex, up to attempts times.
+// Whenever an attempt times out, onRetry is called (e.g. to send a newline
+// to wake a silent device) before trying again. If none of them matched,
+// the *TimeoutError of the last attempt is returned. Each attempt takes a
+// timeout, since a plain ExpectRegexFind on a silent device would never
+// return to be retried. The output ending fails at once rather than being
+// retried, as no poke brings back a stream that has ended. attempts must
+// be at least 1.
+func (expect *ExpectIO) ExpectRetry(regex string, attempts int, timeout time.Duration, onRetry func()) ([]string, error) {
+	if attempts < 1 {
+		return nil, errors.New("gexpect: attempts must be at least 1")
+	}
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < attempts; i++ {
+		if i > 0 && onRetry != nil {
+			onRetry()
+		}
+		done, stop := closeAfter(timeout)
+		pairs, out, findErr := expect.regexFind(re, expect.maxBufferSize, false, done)
+		stop()
+		if findErr == nil {
+			return submatches(out, pairs), nil
+		}
+		if findErr != errCanceled {
+			return nil, findErr
+		}
+		err = &TimeoutError{Pattern: regex, Timeout: timeout, Output: out}
+	}
+	return nil, err
+}
+
+// ExpectRegexWithRetryHook is like ExpectRegexFind, but calls hook with
+// the output read so far each time a read doesn't bring a match, e.g. to
+// nudge a device that has gone quiet or to give up on seeing an error.
+// Once hook returns false the search stops with ErrAborted, leaving the
+// output for the next call. hook may Send, but must not search itself.
+func (expect *ExpectIO) ExpectRegexWithRetryHook(pattern string, hook func(buffered string) bool) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	expect.missHook = hook
+	defer func() { expect.missHook = nil }()
+	pairs, out, err := expect.regexFind(re, expect.maxBufferSize, false, nil)
+	return submatches(out, pairs), err
+}
+
+// ExpectLineRegex waits for a whole line of output that regex matches
+// from start to end, whether it ends in "\n" or "\r\n", and returns its
+// groups with the line ending left out of them. The line ending is
+// consumed. A "$" at the end of regex matches before either ending.
+func (expect *ExpectIO) ExpectLineRegex(regex string) ([]string, error) {
+	re, err := regexp.Compile(`(?m)^(?:` + trimEndAnchor(regex) + `)\r?$\n`)
+	if err != nil {
+		return nil, err
+	}
+	pairs, out, err := expect.expectRegexFindIndex(re)
+	if err != nil {
+		return nil, err
+	}
+	groups := submatches(out, pairs)
+	groups[0] = strings.TrimSuffix(groups[0], "\n")
+	for i := range groups {
+		groups[i] = strings.TrimSuffix(groups[i], "\r")
+	}
+	return groups, nil
+}
+
+// trimEndAnchor drops a trailing "$" from regex, unless it is escaped.
+// In multi-line mode it would only match before the "\n", not the "\r".
+func trimEndAnchor(regex string) string {
+	if !strings.HasSuffix(regex, "$") {
+		return regex
+	}
+	backslashes := 0
+	for i := len(regex) - 2; i >= 0 && regex[i] == '\\'; i-- {
+		backslashes++
+	}
+	if backslashes%2 == 1 {
+		return regex
+	}
+	return regex[:len(regex)-1]
+}
+
+// ExpectRegexAnchored is like ExpectRegexFind, but only succeeds if regex
+// matches right at the start of the unread output instead of skipping
+// ahead to the first match. On failure the output read is put back.
+func (expect *ExpectIO) ExpectRegexAnchored(regex string) ([]string, error) {
+	re, err := regexp.Compile(`\A(?:` + regex + `)`)
+	if err != nil {
+		return nil, err
+	}
+	pairs, out, err := expect.regexFind(re, expect.maxBufferSize, true, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ExpectRegexAnchored didn't find regex '%v' at the start of the output.", regex)
+	}
+	return submatches(out, pairs), nil
+}
+
+// ExpectBool waits for either truePattern or falsePattern and reports which
+// one appeared first. An error is returned if the output ends without
+// either of them.
+func (expect *ExpectIO) ExpectBool(truePattern, falsePattern string) (bool, error) {
+	alt, err := compileAlternation([]string{truePattern, falsePattern})
+	if err != nil {
+		return false, err
+	}
+	pairs, _, err := expect.expectRegexFindIndex(alt.re)
+	if err != nil {
+		return false, err
+	}
+	return alt.which(pairs) == 0, nil
+}
+
+// ExpectAnyResult waits for whichever of patterns appears first. It returns
+// the index of that pattern, the text it matched and the output preceding
+// the match. Without patterns, or with an empty one, it fails with
+// ErrEmptySearch.
+func (expect *ExpectIO) ExpectAnyResult(patterns ...string) (index int, matched string, output string, err error) {
+	if len(patterns) == 0 {
+		return -1, "", "", ErrEmptySearch
+	}
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return -1, "", "", ErrEmptySearch
+		}
+	}
+	alt, err := compileAlternation(patterns)
+	if err != nil {
+		return -1, "", "", err
+	}
+	pairs, out, err := expect.expectRegexFindIndex(alt.re)
+	if err != nil {
+		return -1, "", out, err
+	}
+	return alt.which(pairs), out[pairs[0]:pairs[1]], out[:pairs[0]], nil
+}
+
+// ExpectFirst waits up to timeout for whichever of patterns appears first
+// and returns its index and the groups of its match. On timeout the index
+// is -1 and the error a *TimeoutError. It is ExpectSwitch without actions.
+// Without patterns, or with an empty one, it fails with ErrEmptySearch.
+func (expect *ExpectIO) ExpectFirst(timeout time.Duration, patterns ...string) (int, []string, error) {
+	if len(patterns) == 0 {
+		return -1, nil, ErrEmptySearch
+	}
+	cases := make([]ExpectCase, len(patterns))
+	for i, pattern := range patterns {
+		if pattern == "" {
+			return -1, nil, ErrEmptySearch
+		}
+		cases[i].Pattern = pattern
+	}
+	return expect.ExpectSwitch(timeout, cases...)
+}
+
+// ExpectAll waits until every one of patterns has appeared, in any order,
+// within timeout. Each match consumes the output up to its end, so the
+// patterns need to match separate parts of the output. On timeout the
+// *TimeoutError lists the patterns still outstanding.
+func (expect *ExpectIO) ExpectAll(timeout time.Duration, patterns ...string) error {
+	outstanding := append([]string(nil), patterns...)
+	done, stop := closeAfter(timeout)
+	defer stop()
+	for len(outstanding) > 0 {
+		alt, err := compileAlternation(outstanding)
+		if err != nil {
+			return err
+		}
+		pairs, out, err := expect.regexFind(alt.re, expect.maxBufferSize, false, done)
+		if err == errCanceled {
+			return &TimeoutError{Pattern: strings.Join(outstanding, ", "), Timeout: timeout, Output: out}
+		}
+		if err != nil {
+			return fmt.Errorf("ExpectAll didn't find %q.", outstanding)
+		}
+		i := alt.which(pairs)
+		outstanding = append(outstanding[:i], outstanding[i+1:]...)
+	}
+	return nil
+}
+
+// ExpectCase is one branch of ExpectSwitch. A case with an empty Pattern is
+// taken on timeout, like the timeout keyword of Tcl's expect.
+type ExpectCase struct {
+	Pattern string
+	// Action, if set, is called with the groups of the match when the
+	// case is taken.
+	Action func(groups []string)
+}
+
+// ExpectSwitch waits for whichever case's pattern appears first and returns
+// its index in cases along with the groups of the match. If nothing matches
+// within timeout the timeout case is taken; without one, the index is -1
+// and the error a *TimeoutError. With no patterns at all it just waits for
+// the timeout case, or fails with ErrEmptySearch if there is none.
+func (expect *ExpectIO) ExpectSwitch(timeout time.Duration, cases ...ExpectCase) (int, []string, error) {
+	var patterns []string
+	var indexes []int
+	timeoutCase := -1
+	for i, c := range cases {
+		if c.Pattern == "" {
+			timeoutCase = i
+			continue
+		}
+		patterns = append(patterns, c.Pattern)
+		indexes = append(indexes, i)
+	}
+	if len(patterns) == 0 {
+		// Nothing to match: only the timeout case can be taken.
+		if timeoutCase < 0 {
+			return -1, nil, ErrEmptySearch
+		}
+		time.Sleep(timeout)
+		if action := cases[timeoutCase].Action; action != nil {
+			action(nil)
+		}
+		return timeoutCase, nil, nil
+	}
+	alt, err := compileAlternation(patterns)
+	if err != nil {
+		return -1, nil, err
+	}
+	done, stop := closeAfter(timeout)
+	defer stop()
+	pairs, out, err := expect.regexFind(alt.re, expect.maxBufferSize, false, done)
+	if err == errCanceled {
+		if timeoutCase < 0 {
+			return -1, nil, &TimeoutError{Pattern: alt.re.String(), Timeout: timeout, Output: out}
+		}
+		if action := cases[timeoutCase].Action; action != nil {
+			action(nil)
+		}
+		return timeoutCase, nil, nil
+	}
+	if err != nil {
+		return -1, nil, err
+	}
+	i := alt.which(pairs)
+	groups := alt.submatches(out, pairs, i)
+	if action := cases[indexes[i]].Action; action != nil {
+		action(groups)
+	}
+	return indexes[i], groups, nil
+}
+
+// ExpectRegexFindSubmatchIndex is like ExpectRegexFind, but returns the
+// byte offsets of the match and its groups in output, as
+// regexp.FindStringSubmatchIndex does, along with the output read up to the
+// end of the match. Groups that didn't take part are -1.
+func (expect *ExpectIO) ExpectRegexFindSubmatchIndex(regex string) (loc []int, output string, err error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, "", err
+	}
+	return expect.expectRegexFindIndex(re)
+}
+
+// ExpectRegexTimed is like ExpectRegexFind, but also returns how long the
+// match took from the call, e.g. to track how fast a device responds.
+func (expect *ExpectIO) ExpectRegexTimed(regex string) ([]string, time.Duration, error) {
+	start := time.Now()
+	matches, err := expect.ExpectRegexFind(regex)
+	return matches, time.Since(start), err
+}
+
+// ExpectRegexFlags is like ExpectRegexFind, but parses regex with flags
+// instead of the syntax.Perl flags regexp.Compile uses, for patterns from
+// configuration whose behaviour must be forced. Start from syntax.Perl:
+// add syntax.DotNL for (?s), syntax.FoldCase for (?i) or syntax.NonGreedy
+// for (?U), and remove syntax.OneLine for (?m). Inline flags in regex
+// still apply on top, so it can switch these off again.
+func (expect *ExpectIO) ExpectRegexFlags(regex string, flags syntax.Flags) ([]string, error) {
+	parsed, err := syntax.Parse(regex, flags)
+	if err != nil {
+		return nil, err
+	}
+	// String spells out the flags, e.g. (?s:.), so they survive compiling.
+	re, err := regexp.Compile(parsed.String())
+	if err != nil {
+		return nil, err
+	}
+	pairs, out, err := expect.expectRegexFindIndex(re)
+	return submatches(out, pairs), err
+}
+
+// ExpectRegexFindMax is like ExpectRegexFind, but keeps only the last
+// maxBytes of output for matching during this call instead of the limit
+// set by SetMaxBufferSize.
+func (expect *ExpectIO) ExpectRegexFindMax(regex string, maxBytes int) ([]string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, err
+	}
+	pairs, out, err := expect.regexFind(re, maxBytes, false, nil)
+	return submatches(out, pairs), err
+}
+
+// ExpectBetween waits for the regex start, then for the regex end, and
+// returns the output in between, excluding both matches. It suits pulling
+// a block delimited by markers out of a log.
+func (expect *ExpectIO) ExpectBetween(start, end string) (string, error) {
+	startRe, err := regexp.Compile(start)
+	if err != nil {
+		return "", err
+	}
+	endRe, err := regexp.Compile(end)
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := expect.expectRegexFindIndex(startRe); err != nil {
+		return "", err
+	}
+	pairs, out, err := expect.expectRegexFindIndex(endRe)
+	if err != nil {
+		return "", err
+	}
+	return out[:pairs[0]], nil
+}
+
+// ExpectBetweenTimeout is like ExpectBetween, but gives up once both
+// markers haven't been seen within d, with a *TimeoutError whose Pattern
+// tells which one was missing. If start was seen, the output that came
+// after it is returned along with the error, and also left for the next
+// call, while start itself stays consumed.
+func (expect *ExpectIO) ExpectBetweenTimeout(start, end string, d time.Duration) (string, error) {
+	startRe, err := regexp.Compile(start)
+	if err != nil {
+		return "", err
+	}
+	endRe, err := regexp.Compile(end)
+	if err != nil {
+		return "", err
+	}
+	done, stop := closeAfter(d)
+	defer stop()
+	if _, out, err := expect.regexFind(startRe, expect.maxBufferSize, false, done); err != nil {
+		if err == errCanceled {
+			return "", &TimeoutError{Pattern: start, Timeout: d, Output: out}
+		}
+		return "", err
+	}
+	pairs, out, err := expect.regexFind(endRe, expect.maxBufferSize, false, done)
+	if err == errCanceled {
+		return out, &TimeoutError{Pattern: end, Timeout: d, Output: out}
+	}
+	if err != nil {
+		return "", err
+	}
+	return out[:pairs[0]], nil
+}
+
+// ExpectExactlyOnce waits for the regex until, then returns the groups of
+// regex in the output before it. It fails unless regex matches there
+// exactly once, which catches a message that was printed twice where the
+// first match alone would hide it. Matches are counted without overlap.
+func (expect *ExpectIO) ExpectExactlyOnce(regex, until string) ([]string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, err
+	}
+	untilRe, err := regexp.Compile(until)
+	if err != nil {
+		return nil, err
+	}
+	pairs, out, err := expect.expectRegexFindIndex(untilRe)
+	if err != nil {
+		return nil, err
+	}
+	before := out[:pairs[0]]
+	all := re.FindAllStringSubmatchIndex(before, -1)
+	if len(all) != 1 {
+		return nil, fmt.Errorf("ExpectExactlyOnce found regex '%v' %d times before '%v'.", regex, len(all), until)
+	}
+	return submatches(before, all[0]), nil
+}
+
 func (expect *ExpectIO) ExpectRegexFindWithOutput(regex string) ([]string, string, error) {
 	return expect.expectRegexFind(regex, true)
 }
 
+// ExpectRegexFindWithOutputTimeout is like ExpectRegexFindWithOutput, but
+// gives up after timeout with a *TimeoutError holding the partial output.
+// Reaching the end of the output without a match is reported as a plain
+// error, so the two cases can be told apart.
+func (expect *ExpectIO) ExpectRegexFindWithOutputTimeout(regex string, timeout time.Duration) ([]string, string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, "", err
+	}
+	done, stop := closeAfter(timeout)
+	defer stop()
+	pairs, out, err := expect.regexFind(re, expect.maxBufferSize, false, done)
+	if err == errCanceled {
+		return nil, out, &TimeoutError{Pattern: regex, Timeout: timeout, Output: out}
+	}
+	return submatches(out, pairs), out, err
+}
+
+// ExpectRegexIdleTimeout is like ExpectRegexFind, but gives up with a
+// *TimeoutError once no output has arrived for idle. Unlike the other
+// timeouts it allows any total time as long as the child keeps talking.
+func (expect *ExpectIO) ExpectRegexIdleTimeout(regex string, idle time.Duration) ([]string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		timer := time.NewTimer(idle)
+		defer timer.Stop()
+		for {
+			select {
+			case <-finished:
+				return
+			case <-timer.C:
+				silent := time.Since(expect.buf.lastReadTime())
+				if silent >= idle {
+					close(done)
+					return
+				}
+				timer.Reset(idle - silent)
+			}
+		}
+	}()
+	pairs, out, err := expect.regexFind(re, expect.maxBufferSize, false, done)
+	if err == errCanceled {
+		return nil, &TimeoutError{Pattern: regex, Timeout: idle, Output: out}
+	}
+	return submatches(out, pairs), err
+}
+
 func (expect *ExpectIO) ExpectTimeoutRegexFindWithOutput(regex string, timeout time.Duration) ([]string, string, error) {
 	return expect.expectTimeoutRegexFind(regex, timeout)
 }
@@ -165,23 +1249,58 @@ func buildKMPTable(searchString string) []int {
 	return table
 }
 
-func (expect *ExpectIO) ExpectTimeout(searchString string, timeout time.Duration) (e error) {
-	result := make(chan error)
-	go func() {
-		result <- expect.Expect(searchString)
-	}()
-	select {
-	case e = <-result:
-	case <-time.After(timeout):
-		e = fmt.Errorf("Expect timed out after %v waiting for '%v'.\nOutput:\n%s", timeout, searchString, expect.Collect())
+// ExpectTimeout is like Expect, but gives up after timeout with a
+// *TimeoutError. The output read meanwhile isn't consumed, so that a retry
+// picks up where this call left off.
+func (expect *ExpectIO) ExpectTimeout(searchString string, timeout time.Duration) error {
+	done, stop := closeAfter(timeout)
+	defer stop()
+	output, err := expect.expectString(searchString, done)
+	if err == errCanceled {
+		return &TimeoutError{Pattern: searchString, Timeout: timeout, Output: output}
 	}
-	return e
+	return err
 }
 
+// Expect reads until searchString appears in the output. The search runs
+// Knuth-Morris-Pratt over the stream as it is read, so partial matches
+// carry over between reads and nothing is scanned twice: the cost is
+// linear in the amount of output regardless of the pattern.
 func (expect *ExpectIO) Expect(searchString string) (e error) {
+	_, err := expect.expectString(searchString, nil)
+	return err
+}
+
+// ExpectWord is like Expect, but only finds token as a whole word, so that
+// "ok" isn't found in "broken". Where token starts or ends with something
+// other than a letter, digit or underscore no word boundary is required
+// there.
+func (expect *ExpectIO) ExpectWord(token string) error {
+	if token == "" {
+		return ErrEmptySearch
+	}
+	pattern := regexp.QuoteMeta(token)
+	if isWordByte(token[0]) {
+		pattern = `\b` + pattern
+	}
+	if isWordByte(token[len(token)-1]) {
+		pattern += `\b`
+	}
+	_, _, err := expect.expectRegexFindIndex(regexp.MustCompile(pattern))
+	return err
+}
+
+// isWordByte reports whether c is a word character as \b sees it.
+func isWordByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// expectString searches for searchString. Once done is closed it stops with
+// errCanceled, and returns the output read so far after putting it back.
+func (expect *ExpectIO) expectString(searchString string, done <-chan struct{}) (string, error) {
 	target := len(searchString)
 	if target < 1 {
-		return ErrEmptySearch
+		return "", ErrEmptySearch
 	}
 	chunk := make([]byte, target*2)
 	if expect.outputBuffer != nil {
@@ -191,25 +1310,55 @@ func (expect *ExpectIO) Expect(searchString string) (e error) {
 	i := 0
 	// Build KMP Table
 	table := buildKMPTable(searchString)
+	captured := len(expect.outputBuffer)
+	var read []byte
+	// Matches starting within echo to ignore are skipped.
+	echo := expect.echoLeft
+	expect.echoLeft = 0
+	skipped := 0
+	reads := expect.buf.readCount()
 
 	for {
-		n, err := expect.buf.Read(chunk)
+		n, err := expect.buf.readOrDone(chunk, done)
+		if err == errCanceled {
+			if expect.outputBuffer != nil {
+				expect.outputBuffer = expect.outputBuffer[:captured]
+			}
+			expect.buf.PutBack(read)
+			expect.echoLeft = echo
+			expect.buf.debugf("debug", "search for %q gave up after %d bytes", searchString, len(read))
+			return string(read), err
+		}
 		if n == 0 && err != nil {
-			return err
+			expect.buf.debugf("debug", "no match for %q: %v", searchString, err)
+			if expect.buf.scrollback != nil {
+				return "", expect.withScrollback(fmt.Errorf("Expect didn't find '%v': %w", searchString, err))
+			}
+			return "", err
 		}
-		if expect.outputBuffer != nil {
-			expect.outputBuffer = append(expect.outputBuffer, chunk[:n]...)
+		read = append(read, chunk[:n]...)
+		skip := 0
+		if skipped < echo {
+			skip = echo - skipped
+			if skip > n {
+				skip = n
+			}
+			skipped += skip
 		}
-		offset := m + i
+		offset := m + i - skip
 		for m+i-offset < n {
 			if searchString[i] == chunk[m+i-offset] {
 				i += 1
 				if i == target {
 					unreadIndex := m + i - offset
-					if len(chunk) > unreadIndex {
-						expect.buf.PutBack(chunk[unreadIndex:n])
-					}
-					return nil
+					expect.buf.debugf("debug", "matched %q", searchString)
+					expect.capture(chunk[:unreadIndex])
+					expect.buf.PutBack(chunk[unreadIndex:n])
+					rest := expect.restOfLine(chunk[:unreadIndex])
+					expect.capture(rest)
+					expect.sinceLast = string(read[:len(read)-n+unreadIndex]) + string(rest)
+					expect.fromBuffer = expect.buf.readCount() == reads
+					return "", nil
 				}
 			} else {
 				m += i - table[i]
@@ -220,19 +1369,131 @@ func (expect *ExpectIO) Expect(searchString string) (e error) {
 				}
 			}
 		}
+		expect.capture(chunk[:n])
 	}
 }
 
-func (expect *ExpectIO) Send(command string) error {
-	if _, err := io.WriteString(expect.buf.rw, command); err != nil {
-		return err
+// ExpectBytesCount reads exactly n bytes, whatever they are, e.g. the body
+// of a length-prefixed frame. If the output ends first, the bytes read so
+// far are returned with the error. A negative n fails with
+// ErrNegativeCount.
+func (expect *ExpectIO) ExpectBytesCount(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, ErrNegativeCount
 	}
+	data := make([]byte, n)
+	got, err := io.ReadFull(expect.buf, data)
+	return data[:got], err
+}
+
+// ExpectJSON reads one JSON value from the output and unmarshals it into v,
+// which makes talking to tools that print newline-delimited JSON easy.
+// Leading white space is skipped, and whatever follows the value is left
+// for the next call.
+func (expect *ExpectIO) ExpectJSON(v interface{}) error {
+	dec := json.NewDecoder(expect.buf)
+	err := dec.Decode(v)
+	rest, _ := ioutil.ReadAll(dec.Buffered())
+	expect.buf.PutBack(rest)
+	return err
+}
 
-	if err := expect.buf.rw.Flush(); err != nil {
+// SendConfirm sends command and waits up to timeout for the device to echo
+// it back, to catch commands lost on an unreliable link right away rather
+// than on a missing prompt later.
+func (expect *ExpectIO) SendConfirm(command string, timeout time.Duration) error {
+	if err := expect.Send(command); err != nil {
 		return err
 	}
+	return expect.ExpectTimeout(command, timeout)
+}
 
-	return nil
+// WaitReady waits for a child that prints nothing when it starts up to be
+// ready, by sending probe every so often until response appears in the
+// output. It fails with a *TimeoutError if that takes longer than timeout.
+// Under a PTY probe is echoed, so response must not be part of it.
+func (expect *ExpectIO) WaitReady(probe, response string, timeout time.Duration) error {
+	re := regexp.MustCompile(regexp.QuoteMeta(response))
+	deadline := time.Now().Add(timeout)
+	var output string
+	for {
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return &TimeoutError{Pattern: response, Timeout: timeout, Output: output}
+		}
+		if wait > readyProbeInterval {
+			wait = readyProbeInterval
+		}
+		if err := expect.Send(probe); err != nil {
+			return err
+		}
+		done, stop := closeAfter(wait)
+		_, out, err := expect.regexFind(re, expect.maxBufferSize, false, done)
+		stop()
+		if err != errCanceled {
+			return err
+		}
+		output = out
+	}
+}
+
+// readyProbeInterval is how often WaitReady sends its probe.
+const readyProbeInterval = 250 * time.Millisecond
+
+// ExpectNothing asserts that no more output arrives within the given time,
+// e.g. no error message after the final prompt. The end of the output
+// counts as nothing. Any output is left unread and included in the error.
+func (expect *ExpectIO) ExpectNothing(within time.Duration) error {
+	if expect.buf.buffered() == 0 {
+		select {
+		case r := <-expect.buf.readAsync():
+			expect.buf.finishAsync(r)
+			if len(r.data) == 0 {
+				return nil
+			}
+		case <-time.After(within):
+			return nil
+		}
+	}
+	data, _ := expect.Peek(expect.buf.buffered())
+	return fmt.Errorf("Expected no more output, got %q", data)
+}
+
+// Peek returns the next n bytes of output without consuming them. If the
+// output ends first, the bytes available are returned with the error. A
+// negative n fails with ErrNegativeCount.
+func (expect *ExpectIO) Peek(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, ErrNegativeCount
+	}
+	data := make([]byte, n)
+	got, err := io.ReadFull(expect.buf, data)
+	expect.buf.PutBack(data[:got])
+	return data[:got], err
+}
+
+// Send writes command to the child exactly as given. Nothing is appended
+// and newlines are not translated; use SendLine for that. Short writes are
+// retried, and a write that fails is reported as a *SendError.
+// Send may be called while another goroutine is blocked in a search or
+// read on the same ExpectIO, e.g. from a timer that nudges the device, as
+// the two share no state. Concurrent sends are written one after another.
+func (expect *ExpectIO) Send(command string) error {
+	_, err := expect.buf.Write([]byte(command))
+	return err
+}
+
+// SendBytes writes b to the child unchanged, for binary protocols whose
+// payloads aren't text. It returns the number of bytes written.
+func (expect *ExpectIO) SendBytes(b []byte) (int, error) {
+	return expect.buf.Write(b)
+}
+
+// SendReader copies everything from r to the child, e.g. to feed a script
+// into a REPL without reading it into memory first. It returns the number
+// of bytes copied.
+func (expect *ExpectIO) SendReader(r io.Reader) (int64, error) {
+	return io.Copy(expect.buf, r)
 }
 
 func (expect *ExpectIO) Capture() {
@@ -241,6 +1502,13 @@ func (expect *ExpectIO) Capture() {
 	}
 }
 
+// capture adds output consumed by Expect to what Collect returns.
+func (expect *ExpectIO) capture(data []byte) {
+	if expect.outputBuffer != nil {
+		expect.outputBuffer = append(expect.outputBuffer, data...)
+	}
+}
+
 func (expect *ExpectIO) Collect() []byte {
 	collectOutput := make([]byte, len(expect.outputBuffer))
 	copy(collectOutput, expect.outputBuffer)
@@ -248,16 +1516,279 @@ func (expect *ExpectIO) Collect() []byte {
 	return collectOutput
 }
 
+// SetDecoder transcodes everything read from the child to UTF-8 with d
+// before it is matched, which is needed for devices speaking GBK, Latin-1
+// and the like. Passing nil restores the raw byte stream. Output already
+// read ahead is kept as it was decoded before.
+func (expect *ExpectIO) SetDecoder(d *encoding.Decoder) {
+	expect.buf.decoder = d
+	expect.buf.resetReader()
+}
+
+// SinceLastMatch returns the output consumed by the last successful search,
+// from where it started, normally the end of the match before, through the
+// end of its own match: e.g. the output of a command along with the prompt
+// that followed it. Output read in between with ReadLine and the like is
+// not included.
+func (expect *ExpectIO) SinceLastMatch() string {
+	return expect.sinceLast
+}
+
+// LastMatchFromBuffer reports whether the last successful search found its
+// match in output that had already been read, without waiting for the
+// child, to tell buffering effects from the latency of the device.
+func (expect *ExpectIO) LastMatchFromBuffer() bool {
+	return expect.fromBuffer
+}
+
+// Unread pushes data back in front of the unread output, so that the next
+// read or match sees it first.
+func (expect *ExpectIO) Unread(data []byte) {
+	expect.buf.PutBack(data)
+}
+
+// HasPending reports whether output is available that can be read without
+// blocking, either put back by a previous match or already buffered from
+// the child.
+func (expect *ExpectIO) HasPending() bool {
+	return expect.buf.buffered() > 0
+}
+
+// SetMirror copies everything received from the child to w as it arrives,
+// e.g. to show a watching user the session live. The copy is of the raw
+// bytes, before any decoding. Passing nil turns mirroring off.
+func (expect *ExpectIO) SetMirror(w io.Writer) {
+	expect.buf.mirror = w
+}
+
+// SetLoggers copies everything sent to the child to sent and everything
+// received from it to received, keeping the two directions apart, e.g. to
+// diff sessions or to record only the output for NewExpectIOReplay. Either
+// may be nil to log only one direction.
+func (expect *ExpectIO) SetLoggers(sent, received io.Writer) {
+	expect.buf.sentLog = sent
+	expect.buf.receivedLog = received
+}
+
+// OnLine calls f with each complete line of output as it is read, without
+// its line ending, e.g. to forward a child's log to a structured logger
+// while waiting for a final match. Passing nil turns it off.
+func (expect *ExpectIO) OnLine(f func(line string)) {
+	expect.buf.onLine = f
+	expect.buf.partialLine = nil
+}
+
+// SetMaxBufferSize bounds the memory used by regex searches: only the last
+// n bytes of output are kept to match against, and older output is dropped
+// as more arrives. Matches must fit within the last n bytes, and one that
+// does is found however much output was dropped before it. An n of 0, the
+// default, keeps everything.
+func (expect *ExpectIO) SetMaxBufferSize(n int) {
+	expect.maxBufferSize = n
+}
+
+// SetMaxLineLength bounds how much ReadLine and ReadUntil gather: once n
+// bytes have come without the delimiter, they are returned with
+// ErrLineTooLong, and the rest of the line is left for the next call. This
+// keeps a child that never ends its line from using up memory. An n of 0,
+// the default, sets no bound.
+func (expect *ExpectIO) SetMaxLineLength(n int) {
+	expect.maxLineLength = n
+}
+
+// SetReportTruncated makes regex searches that reach the end of the output
+// partway through what could have become a match return a *TruncatedError
+// holding that unfinished tail, instead of the usual error. This tells a
+// line cut off by a child exiting early from one that never appeared.
+func (expect *ExpectIO) SetReportTruncated(report bool) {
+	expect.reportTruncated = report
+}
+
+// SetMatchWholeLine makes a successful Expect or regex search also consume
+// the rest of the line the match ends on, through the next "\n", so that
+// the next search starts on a fresh line. That rest is added to any output
+// returned. Nothing more is consumed when the match ends with "\n". Only
+// output already received is consumed, so a match on a prompt that no
+// newline follows doesn't wait for one, and the end of a line that is
+// still arriving is left for the next search. Note that a later search for
+// something on the same line as an earlier match won't find it.
+func (expect *ExpectIO) SetMatchWholeLine(whole bool) {
+	expect.matchWholeLine = whole
+}
+
+// restOfLine consumes and returns the output received so far up to and
+// including the end of the line matched ends on, if SetMatchWholeLine is
+// on. It never blocks.
+func (expect *ExpectIO) restOfLine(matched []byte) []byte {
+	if !expect.matchWholeLine || bytes.HasSuffix(matched, []byte("\n")) {
+		return nil
+	}
+	var rest []byte
+	chunk := make([]byte, 256)
+	for {
+		available := expect.buf.buffered()
+		if available == 0 {
+			return rest
+		}
+		if available > len(chunk) {
+			available = len(chunk)
+		}
+		n, _ := expect.buf.Read(chunk[:available])
+		if i := bytes.IndexByte(chunk[:n], '\n'); i >= 0 {
+			expect.buf.PutBack(chunk[i+1 : n])
+			return append(rest, chunk[:i+1]...)
+		}
+		rest = append(rest, chunk[:n]...)
+	}
+}
+
+// SetDebugLogger makes the searches report what they do to f, to help
+// track down problems: level is "trace" for every read and match attempt,
+// and "debug" for how each search ended. Nothing is reported, at no cost,
+// if f is nil, the default.
+func (expect *ExpectIO) SetDebugLogger(f func(level, msg string)) {
+	expect.buf.debugLog = f
+}
+
+// RunePolicy says what ReadRune does with output that isn't valid UTF-8.
+type RunePolicy int
+
+const (
+	// PolicyReplace returns each invalid byte as U+FFFD, like bufio.
+	PolicyReplace RunePolicy = iota
+	// PolicySkip drops invalid bytes.
+	PolicySkip
+	// PolicyError fails with ErrInvalidUTF8, leaving the invalid byte
+	// unread so that it can still be read raw, e.g. with Peek.
+	PolicyError
+)
+
+// SetRuneErrorPolicy sets how ReadRune deals with invalid UTF-8, including
+// a rune cut off by the end of the output. The default is PolicyReplace.
+// Searches are not affected: Expect compares bytes, and regex searches see
+// invalid bytes as U+FFFD.
+func (expect *ExpectIO) SetRuneErrorPolicy(policy RunePolicy) {
+	expect.buf.runePolicy = policy
+}
+
+// ReadRune reads a single UTF-8 encoded rune from the output.
+func (expect *ExpectIO) ReadRune() (rune, int, error) {
+	return expect.buf.ReadRune()
+}
+
+// SetVerboseErrors makes regex searches that reach the end of the output
+// without a match report the tail of the output and the longest leading
+// part of the regex that did match, to show where things diverged. This
+// costs extra work on failure, so it is off by default.
+func (expect *ExpectIO) SetVerboseErrors(verbose bool) {
+	expect.verboseErrors = verbose
+}
+
+// SetScrollback keeps the last n bytes received from the child in memory
+// and adds them to the error of a failed Expect, Scrollback returns them at
+// any time. This is a cheap alternative to logging the whole session. An n
+// of 0 turns it off.
+func (expect *ExpectIO) SetScrollback(n int) {
+	if n <= 0 {
+		expect.buf.scrollback = nil
+		return
+	}
+	expect.buf.scrollback = &tailBuffer{max: n}
+}
+
+// Scrollback returns the output kept since SetScrollback.
+func (expect *ExpectIO) Scrollback() string {
+	if expect.buf.scrollback == nil {
+		return ""
+	}
+	return expect.buf.scrollback.String()
+}
+
+// withScrollback adds the scrollback, if kept, to the error of a failed
+// match. err stays wrapped, so that errors.Is(err, io.EOF) still holds.
+func (expect *ExpectIO) withScrollback(err error) error {
+	if expect.buf.scrollback == nil {
+		return err
+	}
+	return fmt.Errorf("%w\nScrollback:\n%s", err, expect.buf.scrollback)
+}
+
+// String summarizes the state of expect for debugging, e.g. with
+// t.Logf("%v", exp). Nothing is read or changed. Like the searches, it
+// must not be called while one runs in another goroutine.
+func (expect *ExpectIO) String() string {
+	expect.buf.mu.Lock()
+	ended := expect.buf.ended
+	expect.buf.mu.Unlock()
+	return fmt.Sprintf("ExpectIO{buffered: %d, max buffer size: %d, scrollback: %v, verbose errors: %v, output ended: %v}",
+		expect.buf.buffered(), expect.maxBufferSize, expect.buf.scrollback != nil, expect.verboseErrors, ended)
+}
+
 func (expect *ExpectIO) SendLine(command string) error {
-	return expect.Send(command + "\r\n")
+	if err := expect.Send(command + "\r\n"); err != nil {
+		return err
+	}
+	if expect.ignoreEcho {
+		expect.echoLeft += len(echoOf(command + "\r\n"))
+	}
+	return nil
+}
+
+// SetIgnoreEcho makes searches ignore matches that start within the echo
+// of each line sent with SendLine, so that a prompt or keyword in the
+// command itself isn't taken for the response where echo can't be turned
+// off. Only the length of the echo is used, taken to be what a PTY in
+// cooked mode echoes: the line with each carriage return or newline turned
+// into "\r\n". Unlike ConsumeEcho nothing is checked or removed, the echo
+// stays part of the output. Reads other than searches, such as ReadLine,
+// don't count towards getting past it.
+func (expect *ExpectIO) SetIgnoreEcho(ignore bool) {
+	expect.ignoreEcho = ignore
+	expect.echoLeft = 0
+}
+
+// echoOf is how a terminal echoes sent.
+func echoOf(sent string) string {
+	var echo bytes.Buffer
+	for i := 0; i < len(sent); i++ {
+		if sent[i] == '\r' || sent[i] == '\n' {
+			echo.WriteString("\r\n")
+		} else {
+			echo.WriteByte(sent[i])
+		}
+	}
+	return echo.String()
 }
 
 func (expect *ExpectIO) ReadUntil(delim byte) ([]byte, error) {
+	return expect.readUntil(delim, nil)
+}
+
+// ReadUntilTimeout is like ReadUntil, but gives up once delim hasn't
+// arrived within d, with a *TimeoutError. What was read is returned with
+// it, and also left for the next call.
+func (expect *ExpectIO) ReadUntilTimeout(delim byte, d time.Duration) ([]byte, error) {
+	done, stop := closeAfter(d)
+	defer stop()
+	data, err := expect.readUntil(delim, done)
+	if err == errCanceled {
+		return data, &TimeoutError{Pattern: string(delim), Timeout: d, Output: string(data)}
+	}
+	return data, err
+}
+
+// readUntil reads through delim and returns what came before it. Once
+// done is closed it stops with errCanceled, putting back what it read.
+func (expect *ExpectIO) readUntil(delim byte, done <-chan struct{}) ([]byte, error) {
 	join := make([]byte, 0, 512)
 	chunk := make([]byte, 255)
 
 	for {
-		n, err := expect.buf.Read(chunk)
+		n, err := expect.buf.readOrDone(chunk, done)
+		if err == errCanceled {
+			expect.buf.PutBack(join)
+			return join, err
+		}
 
 		for i := 0; i < n; i++ {
 			if chunk[i] == delim {
@@ -265,6 +1796,9 @@ func (expect *ExpectIO) ReadUntil(delim byte) ([]byte, error) {
 					expect.buf.PutBack(chunk[i+1 : n])
 				}
 				return join, nil
+			} else if expect.maxLineLength > 0 && len(join) == expect.maxLineLength {
+				expect.buf.PutBack(chunk[i:n])
+				return join, ErrLineTooLong
 			} else {
 				join = append(join, chunk[i])
 			}
@@ -281,91 +1815,539 @@ func (expect *ExpectIO) ReadLine() (string, error) {
 	return string(str), err
 }
 
+// ReadLineTimeout is like ReadLine, but gives up once no whole line has
+// arrived within d, with a *TimeoutError. The partial line is returned with
+// it, and also left for the next call.
+func (expect *ExpectIO) ReadLineTimeout(d time.Duration) (string, error) {
+	str, err := expect.ReadUntilTimeout('\n', d)
+	return string(str), err
+}
+
 type buffer struct {
-	rw      *bufio.ReadWriter
-	b       bytes.Buffer
-	collect bool
+	rd          *bufio.Reader
+	out         io.Writer
+	in          io.Reader
+	b           pushback
+	collect     bool
+	decoder     *encoding.Decoder
+	transforms  []func([]byte) []byte
+	linePrefix  *linePrefix
+	onLine      func(line string)
+	debugLog    func(level, msg string)
+	runePolicy  RunePolicy
+	partialLine []byte
+	inflight    chan readResult // background read under way
+	readErr     error           // of a background read, not returned yet
+	mirror      io.Writer
+	fileLog     io.Writer // of (*ExpectSubprocess).LogToFile
+	sentLog     io.Writer
+	receivedLog io.Writer
+	scrollback  *tailBuffer
+	screen      *screen
 
+	sendMu sync.Mutex // keeps concurrent writes to the child whole
+
+	mu         sync.Mutex // guards collection, lastRead, received and ended
 	collection bytes.Buffer
+	collectMax int
+	lastRead   time.Time
+	received   int64 // bytes that have passed lineTap
+	reads      int   // from the child that returned output
+	ended      bool  // reading from the child has failed, e.g. at EOF, other than by timing out
+}
+
+func (buf *buffer) attach(in io.Reader, out io.Writer) {
+	buf.in = in
+	buf.rd = buf.newReader()
+	buf.out = out
+}
+
+// resetReader rebuilds the reader after its layers changed. Output the old
+// one had read ahead, and a read still under way, are kept for later.
+func (buf *buffer) resetReader() {
+	if buf.in == nil {
+		return
+	}
+	buf.settle()
+	if buf.rd != nil {
+		ahead, _ := buf.rd.Peek(buf.rd.Buffered())
+		buf.b.Write(ahead)
+	}
+	buf.rd = buf.newReader()
+}
+
+func (buf *buffer) newReader() *bufio.Reader {
+	var r io.Reader = source{buf}
+	if buf.decoder != nil {
+		r = transform.NewReader(r, buf.decoder)
+	}
+	for _, fn := range buf.transforms {
+		r = &funcTransformer{r: r, fn: fn}
+	}
+	if buf.linePrefix != nil {
+		r = &prefixStripper{r: r, prefix: buf.linePrefix, atLineStart: true}
+	}
+	return bufio.NewReader(lineTap{r, buf})
+}
+
+// source reads the raw output of the child, passing it on to the mirror.
+type source struct {
+	buf *buffer
+}
+
+func (s source) Read(p []byte) (int, error) {
+	n, err := s.buf.in.Read(p)
+	if s.buf.debugLog != nil {
+		s.buf.debugf("trace", "read %d bytes: %q", n, p[:n])
+	}
+	if err != nil {
+		s.buf.debugf("debug", "read failed: %v", err)
+	}
+	// A read deadline passing, as in SettleEcho, doesn't end the output.
+	if err != nil && !os.IsTimeout(err) {
+		s.buf.mu.Lock()
+		s.buf.ended = true
+		s.buf.mu.Unlock()
+	}
+	if n > 0 {
+		s.buf.mu.Lock()
+		s.buf.lastRead = time.Now()
+		s.buf.reads++
+		s.buf.mu.Unlock()
+		if s.buf.mirror != nil {
+			s.buf.mirror.Write(p[:n])
+		}
+		if s.buf.fileLog != nil {
+			s.buf.fileLog.Write(p[:n])
+		}
+		if s.buf.receivedLog != nil {
+			s.buf.receivedLog.Write(p[:n])
+		}
+		if s.buf.scrollback != nil {
+			s.buf.scrollback.Write(p[:n])
+		}
+		if s.buf.screen != nil {
+			s.buf.screen.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+// debugf passes a message to the logger set with SetDebugLogger, if any.
+func (buf *buffer) debugf(level, format string, args ...interface{}) {
+	if buf.debugLog != nil {
+		buf.debugLog(level, fmt.Sprintf(format, args...))
+	}
 }
 
-func (buf *buffer) StartCollecting() {
+// buffered returns the number of bytes that can be read without blocking.
+func (buf *buffer) buffered() int {
+	n := buf.b.Len()
+	if buf.rd != nil && buf.inflight == nil {
+		n += buf.rd.Buffered()
+	}
+	return n
+}
+
+// StartCollecting starts keeping what is read, at most the last max bytes
+// of it if max is positive.
+func (buf *buffer) StartCollecting(max int) {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
 	buf.collect = true
+	buf.collectMax = max
 }
 
 func (buf *buffer) StopCollecting() (result string) {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
 	result = string(buf.collection.Bytes())
 	buf.collect = false
-	buf.collection.Reset()
+	release(&buf.collection)
 	return result
 }
 
-func (buf *buffer) Read(chunk []byte) (int, error) {
-	nread := 0
-	if buf.b.Len() > 0 {
-		n, err := buf.b.Read(chunk)
+// collected returns what has been collected so far without stopping.
+func (buf *buffer) collected() string {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	return buf.collection.String()
+}
+
+// trimCollection drops all but the last max bytes collected, if a maximum
+// was given to StartCollecting.
+func (buf *buffer) trimCollection() {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	if over := buf.collection.Len() - buf.collectMax; buf.collectMax > 0 && over > 0 {
+		buf.collection.Next(over)
+	}
+}
+
+func (buf *buffer) collectedLen() int {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	return buf.collection.Len()
+}
+
+func (buf *buffer) collectedBytes() []byte {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	return append([]byte(nil), buf.collection.Bytes()...)
+}
+
+// readCount returns how many reads from the child have returned output.
+func (buf *buffer) readCount() int {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	return buf.reads
+}
+
+// lastReadTime returns when output last arrived from the child.
+func (buf *buffer) lastReadTime() time.Time {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	return buf.lastRead
+}
+
+func (buf *buffer) record(r rune) {
+	buf.mu.Lock()
+	buf.collection.WriteRune(r)
+	buf.mu.Unlock()
+}
+
+// lineTap passes what is read from r on to buf.onLine line by line, and
+// counts it for Mark. It comes last before buffering, so that every byte
+// is seen once.
+type lineTap struct {
+	r   io.Reader
+	buf *buffer
+}
+
+func (t lineTap) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.buf.mu.Lock()
+		t.buf.received += int64(n)
+		t.buf.mu.Unlock()
+	}
+	if t.buf.onLine == nil {
+		return n, err
+	}
+	data := p[:n]
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		line := append(t.buf.partialLine, data[:i]...)
+		t.buf.partialLine = nil
+		t.buf.onLine(string(bytes.TrimSuffix(line, []byte("\r"))))
+		data = data[i+1:]
+	}
+	t.buf.partialLine = append(t.buf.partialLine, data...)
+	return n, err
+}
+
+// SendError reports a failed write to the child.
+type SendError struct {
+	Written int // bytes written before the failure
+	Err     error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("gexpect: send failed after %d bytes: %v", e.Written, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrWriteAfterClose) hold when the write failed
+// because the child had gone away.
+func (e *SendError) Is(target error) bool {
+	return target == ErrWriteAfterClose && childGone(e.Err)
+}
+
+// childGone reports whether err is how writing to a child that has closed
+// its end fails: a closed pipe, EPIPE, or EIO from a PTY whose child has
+// exited.
+func childGone(err error) bool {
+	return errors.Is(err, io.ErrClosedPipe) || errors.Is(err, os.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.EIO)
+}
+
+// Write sends p to the child, retrying short writes until all of it has
+// been written, and flushes the writer if it buffers, e.g. a
+// *bufio.Writer. If that fails, the error is a *SendError holding the true
+// count.
+func (buf *buffer) Write(p []byte) (int, error) {
+	buf.sendMu.Lock()
+	defer buf.sendMu.Unlock()
+	written := 0
+	for written < len(p) {
+		n, err := buf.out.Write(p[written:])
+		if buf.sentLog != nil {
+			buf.sentLog.Write(p[written : written+n])
+		}
+		written += n
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
 		if err != nil {
-			return n, err
+			return written, &SendError{written, err}
 		}
-		if n == len(chunk) {
-			return n, nil
+	}
+	if f, ok := buf.out.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			return written, &SendError{written, err}
 		}
-		nread = n
 	}
-	fn, err := buf.rw.Read(chunk[nread:])
-	return fn + nread, err
+	return written, nil
 }
 
-func (buf *buffer) ReadRune() (r rune, size int, err error) {
-	l := buf.b.Len()
+type flusher interface {
+	Flush() error
+}
 
-	chunk := make([]byte, utf8.UTFMax)
-	if l > 0 {
-		n, err := buf.b.Read(chunk)
-		if err != nil {
-			return 0, 0, err
+// Read serves what was put back first. It only reads from the child, or
+// waits for a background read, once that is used up, so that it never
+// blocks while output is at hand.
+func (buf *buffer) Read(chunk []byte) (n int, err error) {
+	if buf.b.Len() == 0 {
+		buf.settle()
+	}
+	switch {
+	case buf.b.Len() > 0:
+		n, err = buf.b.Read(chunk)
+	case buf.readErr != nil:
+		err, buf.readErr = buf.readErr, nil
+	default:
+		n, err = buf.rd.Read(chunk)
+	}
+	if n > 0 && buf.collect {
+		buf.mu.Lock()
+		buf.collection.Write(chunk[:n])
+		buf.mu.Unlock()
+	}
+	return n, err
+}
+
+// ReadRune decodes the next rune, dealing with invalid UTF-8 as the
+// policy set with SetRuneErrorPolicy says. A rune cut off by the end of
+// the output counts as invalid.
+func (buf *buffer) ReadRune() (r rune, size int, err error) {
+	for {
+		fillErr := buf.fillRune()
+		if buf.b.Len() == 0 {
+			return 0, 0, fillErr
 		}
-		if utf8.FullRune(chunk[:n]) {
-			r, rL := utf8.DecodeRune(chunk)
-			if n > rL {
-				buf.PutBack(chunk[rL:n])
-			}
-			if buf.collect {
-				buf.collection.WriteRune(r)
+		if fillErr != nil {
+			// Report it once the bytes at hand are used up.
+			buf.readErr = fillErr
+		}
+		r, size = utf8.DecodeRune(buf.b.Bytes())
+		if r == utf8.RuneError && size == 1 {
+			switch buf.runePolicy {
+			case PolicySkip:
+				buf.b.Read(make([]byte, size))
+				continue
+			case PolicyError:
+				return 0, 0, ErrInvalidUTF8
 			}
-			return r, rL, nil
 		}
+		buf.b.Read(make([]byte, size))
+		if buf.collect {
+			buf.record(r)
+		}
+		return r, size, nil
+	}
+}
+
+// fillRune reads from the child until a whole rune, valid or not, is put
+// back, or reading fails.
+func (buf *buffer) fillRune() error {
+	if !utf8.FullRune(buf.b.Bytes()) {
+		buf.settle()
 	}
-	// else add bytes from the file, then try that
-	for l < utf8.UTFMax {
-		fn, err := buf.rw.Read(chunk[l : l+1])
+	for !utf8.FullRune(buf.b.Bytes()) {
+		if buf.readErr != nil {
+			err := buf.readErr
+			buf.readErr = nil
+			return err
+		}
+		var one [1]byte
+		n, err := buf.rd.Read(one[:])
+		buf.b.Write(one[:n])
 		if err != nil {
-			return 0, 0, err
+			return err
 		}
-		l = l + fn
+	}
+	return nil
+}
 
-		if utf8.FullRune(chunk[:l]) {
-			r, rL := utf8.DecodeRune(chunk)
-			if buf.collect {
-				buf.collection.WriteRune(r)
-			}
-			return r, rL, nil
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// readAsync starts reading from the child in the background, unless a read
+// is under way already, and returns the channel its result arrives on. A
+// caller that receives the result must pass it to finishAsync. One that
+// gives up waiting leaves it to the next read, so nothing is lost.
+func (buf *buffer) readAsync() <-chan readResult {
+	if buf.inflight == nil {
+		result := make(chan readResult, 1)
+		buf.inflight = result
+		go func() {
+			chunk := make([]byte, minReadSize)
+			n, err := buf.rd.Read(chunk)
+			result <- readResult{chunk[:n], err}
+		}()
+	}
+	return buf.inflight
+}
+
+// finishAsync makes the result of a background read the next output.
+func (buf *buffer) finishAsync(r readResult) {
+	buf.inflight = nil
+	buf.b.Write(r.data)
+	buf.readErr = r.err
+}
+
+// readOrDone is like Read, but gives up with errCanceled once done is
+// closed. A read left under way keeps its output for later.
+func (buf *buffer) readOrDone(chunk []byte, done <-chan struct{}) (int, error) {
+	if done != nil && buf.buffered() == 0 && buf.readErr == nil {
+		select {
+		case r := <-buf.readAsync():
+			buf.finishAsync(r)
+		case <-done:
+			return 0, errCanceled
 		}
 	}
-	return 0, 0, errors.New("File is not a valid UTF=8 encoding")
+	return buf.Read(chunk)
+}
+
+// hasLine reports whether ReadLine can return without reading more.
+func (buf *buffer) hasLine() bool {
+	return bytes.IndexByte(buf.b.Bytes(), '\n') >= 0 || buf.readErr != nil
+}
+
+// settle waits for any background read to finish.
+func (buf *buffer) settle() {
+	if buf.inflight != nil {
+		buf.finishAsync(<-buf.inflight)
+	}
 }
 
 func (buf *buffer) PutBack(chunk []byte) {
-	if len(chunk) == 0 {
-		return
+	buf.b.unread(chunk)
+}
+
+// pushback holds output that was put back, to be read again before
+// anything new. Putting back what was just read from it only moves the
+// read offset back, so that the cost depends on the bytes put back rather
+// than on how much is held.
+type pushback struct {
+	data []byte
+	off  int
+}
+
+func (p *pushback) Len() int {
+	return len(p.data) - p.off
+}
+
+func (p *pushback) Bytes() []byte {
+	return p.data[p.off:]
+}
+
+func (p *pushback) Read(b []byte) (int, error) {
+	if p.Len() == 0 {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
 	}
-	if buf.b.Len() == 0 {
-		buf.b.Write(chunk)
+	n := copy(b, p.data[p.off:])
+	p.off += n
+	if p.Len() == 0 {
+		p.reset()
+	}
+	return n, nil
+}
+
+// Write adds b after what is held.
+func (p *pushback) Write(b []byte) (int, error) {
+	if p.off > len(p.data)/2 {
+		// Reclaim the space already read.
+		n := copy(p.data, p.data[p.off:])
+		p.data, p.off = p.data[:n], 0
+	}
+	p.data = append(p.data, b...)
+	return len(b), nil
+}
+
+// unread puts chunk in front of what is held.
+func (p *pushback) unread(chunk []byte) {
+	switch {
+	case len(chunk) == 0:
+	case len(chunk) <= p.off:
+		p.off -= len(chunk)
+		copy(p.data[p.off:], chunk)
+	case p.Len() == 0:
+		p.data, p.off = append(p.data[:0], chunk...), 0
+	default:
+		d := make([]byte, len(chunk)+p.Len())
+		copy(d, chunk)
+		copy(d[len(chunk):], p.Bytes())
+		p.data, p.off = d, 0
+	}
+}
+
+// reset empties p, dropping its memory if it grew large.
+func (p *pushback) reset() {
+	if cap(p.data) > maxIdleCapacity {
+		p.data = nil
+	} else {
+		p.data = p.data[:0]
+	}
+	p.off = 0
+}
+
+// maxIdleCapacity is the most memory an emptied buffer keeps for reuse.
+const maxIdleCapacity = 64 * 1024
+
+// release empties b, letting go of its memory if it has grown large, so
+// that one burst of output doesn't stay allocated for the rest of a long
+// session.
+func release(b *bytes.Buffer) {
+	if b.Cap() > maxIdleCapacity {
+		*b = bytes.Buffer{}
 		return
 	}
-	d := make([]byte, 0, len(chunk)+buf.b.Len())
-	d = append(d, chunk...)
-	d = append(d, buf.b.Bytes()...)
-	buf.b.Reset()
-	buf.b.Write(d)
+	b.Reset()
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	max int
+	b   []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.b = append(t.b, p...)
+	if len(t.b) > t.max {
+		t.b = t.b[len(t.b)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.b)
 }
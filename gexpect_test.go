@@ -3,12 +3,22 @@ package gexpect
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"regexp/syntax"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
+
+	"golang.org/x/text/encoding/charmap"
 )
 
 func mockExpectFromString(buffer string) *ExpectIO {
@@ -89,6 +99,41 @@ func TestBiChannel(t *testing.T) {
 	wait("echo2")
 }
 
+func TestBiChannelCancel(t *testing.T) {
+	t.Logf("Testing AsyncInteractChannelsContext stops on cancel... ")
+
+	before := runtime.NumGoroutine()
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, pipeWriter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sender, receiver := exp.AsyncInteractChannelsContext(ctx)
+	sender <- "hello\n"
+	if msg := <-receiver; msg != "hello" {
+		t.Fatalf("Expected hello, got %q", msg)
+	}
+
+	cancel()
+	select {
+	case _, open := <-receiver:
+		if open {
+			t.Fatal("Expected receive to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive wasn't closed after cancel")
+	}
+
+	// The read left waiting on the pipe ends with it.
+	pipeWriter.Close()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines still running", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 var regexMatchTests = []struct {
 	re   string
 	good string
@@ -364,7 +409,7 @@ func TestBufferReadRune(t *testing.T) {
 		}
 
 		// new buffer
-		buf := buffer{rw: bufio.NewReadWriter(bufio.NewReader(f), bufio.NewWriter(f)), b: *bytes.NewBuffer(tt.bufferContent)}
+		buf := buffer{rd: bufio.NewReader(f), out: f, b: pushback{data: append([]byte(nil), tt.bufferContent...)}}
 
 		// call ReadRune
 		r, size, err := buf.ReadRune()
@@ -380,3 +425,1929 @@ func TestBufferReadRune(t *testing.T) {
 	}
 
 }
+
+func TestRuneErrorPolicy(t *testing.T) {
+	t.Logf("Testing rune error policies...")
+	readAll := func(exp *ExpectIO) (string, error) {
+		var runes []rune
+		for {
+			r, _, err := exp.ReadRune()
+			if err != nil {
+				return string(runes), err
+			}
+			runes = append(runes, r)
+		}
+	}
+	// An invalid byte, then a rune cut off by the end of the output.
+	output := "a\xffb\xc2"
+
+	got, err := readAll(mockExpectFromString(output))
+	if got != "a\ufffdb\ufffd" || err != io.EOF {
+		t.Fatalf("Expected replacement, got %q %v", got, err)
+	}
+
+	exp := mockExpectFromString(output)
+	exp.SetRuneErrorPolicy(PolicySkip)
+	got, err = readAll(exp)
+	if got != "ab" || err != io.EOF {
+		t.Fatalf("Expected invalid bytes skipped, got %q %v", got, err)
+	}
+
+	exp = mockExpectFromString(output)
+	exp.SetRuneErrorPolicy(PolicyError)
+	got, err = readAll(exp)
+	if got != "a" || err != ErrInvalidUTF8 {
+		t.Fatalf("Expected ErrInvalidUTF8 after %q, got %q %v", "a", got, err)
+	}
+	if raw, err := exp.Peek(1); err != nil || raw[0] != 0xff {
+		t.Fatalf("Expected the invalid byte left unread, got %q %v", raw, err)
+	}
+}
+
+// chunkReader returns what r reads in pieces of the given sizes in turn.
+type chunkReader struct {
+	r     io.Reader
+	sizes []int
+	i     int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	size := c.sizes[c.i%len(c.sizes)]
+	c.i++
+	if size < len(p) {
+		p = p[:size]
+	}
+	return c.r.Read(p)
+}
+
+func TestWrappedReaderChunking(t *testing.T) {
+	t.Logf("Testing matching over readers with odd chunk sizes...")
+	const output = "caf\u00e9 \u00a9 \u65e5\u672c \U0001f600 login: admin\r\nprompt> "
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(output))
+	zw.Close()
+	readers := map[string]func() io.Reader{
+		"one byte":   func() io.Reader { return iotest.OneByteReader(strings.NewReader(output)) },
+		"half":       func() io.Reader { return iotest.HalfReader(strings.NewReader(output)) },
+		"data error": func() io.Reader { return iotest.DataErrReader(strings.NewReader(output)) },
+		"odd chunks": func() io.Reader { return &chunkReader{r: strings.NewReader(output), sizes: []int{1, 2, 3, 5, 7}} },
+		// Each chunk splits a rune and the pattern.
+		"split runes": func() io.Reader { return &chunkReader{r: strings.NewReader(output), sizes: []int{4, 1, 6, 2, 9, 3}} },
+		"gzip": func() io.Reader {
+			zr, err := gzip.NewReader(iotest.OneByteReader(bytes.NewReader(compressed.Bytes())))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return zr
+		},
+	}
+	for name, newReader := range readers {
+		exp := NewExpectIO(newReader(), ioutil.Discard)
+		var runes []rune
+		for i := 0; i < 4; i++ {
+			r, _, err := exp.ReadRune()
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			runes = append(runes, r)
+		}
+		if string(runes) != "caf\u00e9" {
+			t.Fatalf("%s: expected the runes reassembled, got %q", name, string(runes))
+		}
+		if err := exp.Expect("\u00a9 \u65e5\u672c"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		groups, err := exp.ExpectRegexFind(`\x{1f600} login: (\w+)\r\n`)
+		if err != nil || groups[1] != "admin" {
+			t.Fatalf("%s: expected admin, got %q %v", name, groups, err)
+		}
+		if ok, _ := exp.ExpectRegex(`prompt> $`); !ok {
+			t.Fatalf("%s: expected the prompt at the end of the output", name)
+		}
+	}
+}
+
+func TestSetDecoder(t *testing.T) {
+	t.Logf("Testing Latin-1 decoding...")
+	exp := mockExpectFromString("caf\xe9 ol\xe9\n")
+	exp.SetDecoder(charmap.ISO8859_1.NewDecoder())
+	matches, err := exp.ExpectRegexFind(`caf(.) ol(.)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches[1] != "é" || matches[2] != "é" {
+		t.Fatalf("expected decoded 'é' groups, got %q", matches)
+	}
+}
+
+func TestSetDecoderKeepsReadAhead(t *testing.T) {
+	t.Logf("Testing SetDecoder after output has been read...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	go pipeWriter.Write([]byte("xahead\n"))
+	// Reading one byte leaves the rest read ahead.
+	if _, err := exp.ExpectBytesCount(1); err != nil {
+		t.Fatal(err)
+	}
+	exp.SetDecoder(charmap.ISO8859_1.NewDecoder())
+	if err := exp.SetLinePrefixStrip(`> `); err != nil {
+		t.Fatal(err)
+	}
+	go pipeWriter.Write([]byte("> caf\xe9\n"))
+	if line, err := exp.ReadLine(); err != nil || line != "ahead" {
+		t.Fatalf("Expected the output read ahead, got %q, %v", line, err)
+	}
+	if line, err := exp.ReadLine(); err != nil || line != "café" {
+		t.Fatalf("Expected new output decoded and stripped, got %q, %v", line, err)
+	}
+}
+
+func TestRegexFindNamedDefault(t *testing.T) {
+	t.Logf("Testing named groups with defaults...")
+	exp := mockExpectFromString("port=22 state=\n")
+	groups, err := exp.ExpectRegexFindNamedDefault(`port=(?P<port>\d+)(?: proto=(?P<proto>\w+))? state=(?P<state>\w*)`,
+		map[string]string{"proto": "tcp", "state": "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups["port"] != "22" || groups["proto"] != "tcp" || groups["state"] != "" {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+}
+
+func TestExpectRetry(t *testing.T) {
+	t.Logf("Testing ExpectRetry...")
+	// The device stays silent until it gets a newline.
+	input, inputWriter := io.Pipe()
+	output, outputWriter := io.Pipe()
+	exp := NewExpectIO(output, inputWriter)
+	go func() {
+		lines := bufio.NewScanner(input)
+		for lines.Scan() {
+			outputWriter.Write([]byte("host login: "))
+		}
+	}()
+	retries := 0
+	finishesWithin(t, 3*time.Second, func() {
+		matches, err := exp.ExpectRetry(`(\w+) login:`, 3, 100*time.Millisecond, func() {
+			retries++
+			exp.Send("\n")
+		})
+		if err != nil {
+			t.Error(err)
+		} else if retries != 1 || matches[1] != "host" {
+			t.Errorf("expected one retry and match 'host', got %d retries and %q", retries, matches)
+		}
+	})
+
+	silent, _ := io.Pipe()
+	exp = NewExpectIO(silent, ioutil.Discard)
+	retries = 0
+	finishesWithin(t, 3*time.Second, func() {
+		_, err := exp.ExpectRetry(`login:`, 3, 100*time.Millisecond, func() { retries++ })
+		if _, ok := err.(*TimeoutError); !ok {
+			t.Errorf("expected a *TimeoutError once all attempts are used up, got %v", err)
+		}
+		if retries != 2 {
+			t.Errorf("expected 2 retries, got %d", retries)
+		}
+	})
+
+	exp = mockExpectFromString("booting...\r\n")
+	retries = 0
+	if _, err := exp.ExpectRetry(`login:`, 3, time.Second, func() { retries++ }); err == nil || retries != 0 {
+		t.Fatalf("expected the end of the output to fail without retries, got %d retries and %v", retries, err)
+	}
+
+	exp = mockExpectFromString("login: ")
+	for _, attempts := range []int{0, -1} {
+		if matches, err := exp.ExpectRetry(`login:`, attempts, time.Second, nil); err == nil {
+			t.Fatalf("expected %d attempts to be rejected, got %q", attempts, matches)
+		}
+	}
+}
+
+func TestExpectRegexWithRetryHook(t *testing.T) {
+	t.Logf("Testing ExpectRegexWithRetryHook...")
+	// The device prints a banner, then waits for a newline.
+	input, inputWriter := io.Pipe()
+	output, outputWriter := io.Pipe()
+	exp := NewExpectIO(output, inputWriter)
+	go func() {
+		outputWriter.Write([]byte("booting...\r\n"))
+		lines := bufio.NewScanner(input)
+		for lines.Scan() {
+			outputWriter.Write([]byte("host login: "))
+		}
+	}()
+	var seen []string
+	finishesWithin(t, 3*time.Second, func() {
+		matches, err := exp.ExpectRegexWithRetryHook(`(\w+) login:`, func(buffered string) bool {
+			seen = append(seen, buffered)
+			exp.Send("\n")
+			return true
+		})
+		if err != nil {
+			t.Error(err)
+		} else if len(seen) != 1 || seen[0] != "booting...\r\n" || matches[1] != "host" {
+			t.Errorf("expected one call with the banner and match 'host', got %q and %q", seen, matches)
+		}
+	})
+
+	exp = mockExpectFromString("ERROR: no disk\r\n")
+	_, err := exp.ExpectRegexWithRetryHook(`login:`, func(buffered string) bool {
+		return !strings.Contains(buffered, "ERROR")
+	})
+	if err != ErrAborted {
+		t.Fatalf("expected ErrAborted, got %v", err)
+	}
+	if line, _ := exp.ReadLine(); line != "ERROR: no disk\r" {
+		t.Fatalf("expected the output to be left, got %q", line)
+	}
+}
+
+func TestSendDuringExpect(t *testing.T) {
+	t.Logf("Testing Send while Expect is blocked...")
+	// The device answers each nudge, and is ready after the third.
+	input, inputWriter := io.Pipe()
+	output, outputWriter := io.Pipe()
+	exp := NewExpectIO(output, inputWriter)
+	var mu sync.Mutex
+	var sent []string
+	go func() {
+		lines := bufio.NewScanner(input)
+		for n := 1; lines.Scan(); n++ {
+			mu.Lock()
+			sent = append(sent, lines.Text())
+			mu.Unlock()
+			if n == 3 {
+				outputWriter.Write([]byte("ready\r\n"))
+			} else {
+				outputWriter.Write([]byte("waiting\r\n"))
+			}
+		}
+	}()
+	stop := make(chan struct{})
+	nudged := make(chan struct{})
+	go func() {
+		defer close(nudged)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := exp.Send("nudge\n"); err != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	finishesWithin(t, 3*time.Second, func() {
+		if err := exp.Expect("ready"); err != nil {
+			t.Error(err)
+		}
+	})
+	close(stop)
+	<-nudged
+	output.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) < 3 || sent[0] != "nudge" {
+		t.Fatalf("expected the nudges to arrive whole, got %q", sent)
+	}
+}
+
+func TestHasPending(t *testing.T) {
+	t.Logf("Testing HasPending...")
+	exp := mockExpectFromString("foo\nbar\n")
+	if exp.HasPending() {
+		t.Fatal("nothing should be pending before the first read")
+	}
+	if _, err := exp.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	if !exp.HasPending() {
+		t.Fatal("expected 'bar' to be pending")
+	}
+	if _, err := exp.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	if exp.HasPending() {
+		t.Fatal("nothing should be pending after reading everything")
+	}
+}
+
+func TestRegexAnchored(t *testing.T) {
+	t.Logf("Testing anchored Regular Expression Search...")
+	exp := mockExpectFromString("foo 1\r\nbar 2\r\n")
+	if _, err := exp.ExpectRegexAnchored(`bar (\d)`); err == nil {
+		t.Fatal("expected anchored search to refuse skipping over 'foo'")
+	}
+	matches, err := exp.ExpectRegexAnchored(`foo (\d)\r\n`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches[1] != "1" {
+		t.Fatalf("expected '1', got %q", matches[1])
+	}
+	matches, err = exp.ExpectRegexAnchored(`bar (\d)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches[1] != "2" {
+		t.Fatalf("expected '2', got %q", matches[1])
+	}
+}
+
+func TestExpectBool(t *testing.T) {
+	t.Logf("Testing ExpectBool...")
+	exp := mockExpectFromString("AT\r\nERROR 3\r\nAT\r\nOK\r\n")
+	ok, err := exp.ExpectBool(`(O)K`, `ERROR (\d)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected ERROR to match first")
+	}
+	ok, err = exp.ExpectBool(`(O)K`, `ERROR (\d)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected OK to match second")
+	}
+	if _, err = exp.ExpectBool(`OK`, `ERROR`); err == nil {
+		t.Fatal("expected an error when neither pattern appears")
+	}
+}
+
+func TestSendIsRaw(t *testing.T) {
+	t.Logf("Testing Send writes exactly what it is given...")
+	var out bytes.Buffer
+	exp := NewExpectIO(strings.NewReader(""), &out)
+	if err := exp.Send("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := exp.Send("\n\r\x03"); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "abc\n\r\x03" {
+		t.Fatalf("expected the raw bytes on the wire, got %q", out.String())
+	}
+	if err := exp.SendLine("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "abc\n\r\x03abc\r\n" {
+		t.Fatalf("expected SendLine to append \\r\\n, got %q", out.String())
+	}
+}
+
+func TestRegexFindWithOutputTimeout(t *testing.T) {
+	t.Logf("Testing Regular Expression search with a typed timeout error...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	go pipeWriter.Write([]byte("partial "))
+
+	_, out, err := exp.ExpectRegexFindWithOutputTimeout(`find me`, 100*time.Millisecond)
+	timeoutErr, ok := err.(*TimeoutError)
+	if !ok {
+		t.Fatalf("expected a *TimeoutError, got %v", err)
+	}
+	if out != "partial " || timeoutErr.Output != out {
+		t.Fatalf("expected the partial output, got %q and %q", out, timeoutErr.Output)
+	}
+
+	exp = mockExpectFromString("no match here")
+	_, _, err = exp.ExpectRegexFindWithOutputTimeout(`find me`, time.Second)
+	if _, ok := err.(*TimeoutError); ok || err == nil {
+		t.Fatalf("expected a not found error at the end of output, got %v", err)
+	}
+}
+
+func TestSendReader(t *testing.T) {
+	t.Logf("Testing SendReader...")
+	var out bytes.Buffer
+	exp := NewExpectIO(strings.NewReader(""), &out)
+	script := strings.Repeat("print('hello')\n", 1000)
+	n, err := exp.SendReader(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(script)) || out.String() != script {
+		t.Fatalf("expected %d bytes to be sent, got %d (%d on the wire)", len(script), n, out.Len())
+	}
+}
+
+func TestSetMirror(t *testing.T) {
+	t.Logf("Testing SetMirror...")
+	exp := mockExpectFromString("caf\xe9\r\nprompt> ")
+	var mirror bytes.Buffer
+	exp.SetMirror(&mirror)
+	exp.SetDecoder(charmap.ISO8859_1.NewDecoder())
+	if err := exp.Expect("prompt> "); err != nil {
+		t.Fatal(err)
+	}
+	if mirror.String() != "caf\xe9\r\nprompt> " {
+		t.Fatalf("expected the raw output in the mirror, got %q", mirror.String())
+	}
+}
+
+func benchmarkExpectLiteral(b *testing.B, size int) {
+	// The worst case for a naive search: the stream is one long near miss.
+	searchString := strings.Repeat("a", 99) + "b"
+	stream := strings.Repeat("a", size) + searchString
+	b.SetBytes(int64(len(stream)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		exp := NewExpectIO(strings.NewReader(stream), ioutil.Discard)
+		if err := exp.Expect(searchString); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExpectLiteral1MB(b *testing.B)  { benchmarkExpectLiteral(b, 1<<20) }
+func BenchmarkExpectLiteral10MB(b *testing.B) { benchmarkExpectLiteral(b, 10<<20) }
+
+func TestExpectPartialMatches(t *testing.T) {
+	t.Logf("Testing Expect across partial matches...")
+	tests := []struct {
+		input  string
+		search string
+	}{
+		{"aaab", "aab"},
+		{"ababac", "abac"},
+		{strings.Repeat("ab", 100) + "abc", "ababc"},
+		{strings.Repeat("a", 1000) + "b", strings.Repeat("a", 99) + "b"},
+	}
+	for _, tt := range tests {
+		// Feed the stream one byte at a time so partial matches have
+		// to carry over between reads.
+		exp := NewExpectIO(iotest.OneByteReader(strings.NewReader(tt.input)), ioutil.Discard)
+		if err := exp.Expect(tt.search); err != nil {
+			t.Errorf("didn't find %q in %q: %v", tt.search, tt.input, err)
+		}
+	}
+}
+
+func TestRegexIdleTimeout(t *testing.T) {
+	t.Logf("Testing Regular Expression search with an idle timeout...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	go func() {
+		// Keep talking for longer than the idle timeout in total.
+		for i := 0; i < 6; i++ {
+			time.Sleep(50 * time.Millisecond)
+			pipeWriter.Write([]byte("."))
+		}
+		pipeWriter.Write([]byte("done\r\n$ "))
+	}()
+	if _, err := exp.ExpectRegexIdleTimeout(`done`, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err := exp.ExpectRegexIdleTimeout(`never`, 100*time.Millisecond)
+	if _, ok := err.(*TimeoutError); !ok {
+		t.Fatalf("expected a *TimeoutError, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("idle timeout took too long: %v", elapsed)
+	}
+}
+
+func TestUnread(t *testing.T) {
+	t.Logf("Testing Unread...")
+	exp := mockExpectFromString("foo\nbar\n")
+	line, err := exp.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp.Unread([]byte(line + "\n"))
+	exp.Unread([]byte("> "))
+	matches, err := exp.ExpectRegexFind(`> (\w+)\n(\w+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches[1] != "foo" || matches[2] != "bar" {
+		t.Fatalf("expected the unread data to come first, got %q", matches)
+	}
+}
+
+func TestRegexKeepsUnmatchedTail(t *testing.T) {
+	t.Logf("Testing the unmatched tail carries over between calls...")
+	exp := mockExpectFromString("abc def ghi\r\njkl")
+	match, err := exp.ExpectRegex(`abc`)
+	if err != nil || !match {
+		t.Fatalf("expected 'abc' to match: %v", err)
+	}
+	matches, err := exp.ExpectRegexFind(`^ (d)ef`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches[1] != "d" {
+		t.Fatalf("expected 'd', got %q", matches[1])
+	}
+	if err := exp.Expect(" ghi"); err != nil {
+		t.Fatal(err)
+	}
+	match, err = exp.ExpectRegex(`^\r\njkl$`)
+	if err != nil || !match {
+		t.Fatalf("expected the rest of the output to match: %v", err)
+	}
+}
+
+func TestExpectSwitch(t *testing.T) {
+	t.Logf("Testing ExpectSwitch...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	go pipeWriter.Write([]byte("Password: \r\n"))
+
+	var taken []string
+	cases := []ExpectCase{
+		{Pattern: `(\w+) login:`, Action: func(groups []string) { taken = append(taken, "login "+groups[1]) }},
+		{Pattern: `Pass(word):`, Action: func(groups []string) { taken = append(taken, "password "+groups[1]) }},
+		{Action: func(groups []string) { taken = append(taken, "timeout") }},
+	}
+	i, groups, err := exp.ExpectSwitch(time.Second, cases...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 1 || groups[0] != "Password:" || groups[1] != "word" {
+		t.Fatalf("expected the password case, got %d %q", i, groups)
+	}
+	i, _, err = exp.ExpectSwitch(100*time.Millisecond, cases...)
+	if err != nil || i != 2 {
+		t.Fatalf("expected the timeout case, got %d %v", i, err)
+	}
+	if strings.Join(taken, ",") != "password word,timeout" {
+		t.Fatalf("unexpected actions taken: %q", taken)
+	}
+
+	pipeReader, _ = io.Pipe()
+	exp = NewExpectIO(pipeReader, nil)
+	i, _, err = exp.ExpectSwitch(100*time.Millisecond, cases[:2]...)
+	if _, ok := err.(*TimeoutError); !ok || i != -1 {
+		t.Fatalf("expected -1 and a *TimeoutError without a timeout case, got %d %v", i, err)
+	}
+
+	// Without patterns only the timeout case can be taken.
+	i, _, err = exp.ExpectSwitch(100*time.Millisecond, cases[2])
+	if err != nil || i != 0 {
+		t.Fatalf("expected the timeout case, got %d %v", i, err)
+	}
+	if i, _, err = exp.ExpectSwitch(100 * time.Millisecond); err != ErrEmptySearch || i != -1 {
+		t.Fatalf("expected -1 and ErrEmptySearch without cases, got %d %v", i, err)
+	}
+}
+
+func TestExpectBytesCount(t *testing.T) {
+	t.Logf("Testing ExpectBytesCount...")
+	exp := mockExpectFromString("\x00\x03\xff\xfe\x01rest")
+	length, err := exp.ExpectBytesCount(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := exp.ExpectBytesCount(int(length[0])<<8 | int(length[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, []byte{0xff, 0xfe, 0x01}) {
+		t.Fatalf("unexpected frame %x", frame)
+	}
+	if _, err := exp.ExpectBytesCount(-1); err != ErrNegativeCount {
+		t.Fatalf("expected ErrNegativeCount, got %v", err)
+	}
+	if _, err := exp.Peek(-1); err != ErrNegativeCount {
+		t.Fatalf("expected ErrNegativeCount from Peek, got %v", err)
+	}
+	rest, err := exp.ExpectBytesCount(10)
+	if err != io.ErrUnexpectedEOF || string(rest) != "rest" {
+		t.Fatalf("expected the remaining bytes and io.ErrUnexpectedEOF, got %q %v", rest, err)
+	}
+}
+
+func TestExpectAnyResult(t *testing.T) {
+	t.Logf("Testing ExpectAnyResult...")
+	exp := mockExpectFromString("copying files\r\nERROR 42: disk full\r\n$ ")
+	index, matched, output, err := exp.ExpectAnyResult(`OK`, `ERROR \d+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 1 || matched != "ERROR 42" || output != "copying files\r\n" {
+		t.Fatalf("unexpected result %d %q %q", index, matched, output)
+	}
+
+	if index, _, _, err := exp.ExpectAnyResult(); err != ErrEmptySearch || index != -1 {
+		t.Fatalf("expected ErrEmptySearch without patterns, got %d %v", index, err)
+	}
+	if index, _, _, err := exp.ExpectAnyResult(`\$ `, ``); err != ErrEmptySearch || index != -1 {
+		t.Fatalf("expected ErrEmptySearch with an empty pattern, got %d %v", index, err)
+	}
+}
+
+func TestExpectAll(t *testing.T) {
+	t.Logf("Testing ExpectAll...")
+	exp := mockExpectFromString("db ready\r\ncache ready\r\nweb ready\r\n")
+	if err := exp.ExpectAll(time.Second, `web ready`, `db ready`, `cache ready`); err != nil {
+		t.Fatal(err)
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	exp = NewExpectIO(pipeReader, nil)
+	go pipeWriter.Write([]byte("db ready\r\nweb ready\r\n$ "))
+	err := exp.ExpectAll(200*time.Millisecond, `web ready`, `db ready`, `cache ready`)
+	timeoutErr, ok := err.(*TimeoutError)
+	if !ok {
+		t.Fatalf("expected a *TimeoutError, got %v", err)
+	}
+	if timeoutErr.Pattern != "cache ready" {
+		t.Fatalf("expected only 'cache ready' to be outstanding, got %q", timeoutErr.Pattern)
+	}
+}
+
+func TestScrollback(t *testing.T) {
+	t.Logf("Testing SetScrollback...")
+	exp := mockExpectFromString("line 1\r\nline 2\r\nline 3\r\n")
+	exp.SetScrollback(16)
+	err := exp.Expect("line 4")
+	if err == nil {
+		t.Fatal("expected 'line 4' not to be found")
+	}
+	if exp.Scrollback() != "line 2\r\nline 3\r\n" {
+		t.Fatalf("expected the last 16 bytes, got %q", exp.Scrollback())
+	}
+	if !strings.Contains(err.Error(), "line 2\r\nline 3\r\n") {
+		t.Fatalf("expected the scrollback in the error, got %v", err)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the error to wrap io.EOF, got %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	t.Logf("Testing NewExpectIOReplay...")
+	var transcript bytes.Buffer
+	live := mockExpectFromString("login: Password: \r\nWelcome\r\n$ ")
+	live.SetMirror(&transcript)
+	if err := live.Expect("$ "); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := NewExpectIOReplay(&transcript)
+	if err := exp.Expect("login: "); err != nil {
+		t.Fatal(err)
+	}
+	if err := exp.SendLine("root"); err != nil {
+		t.Fatal(err)
+	}
+	if err := exp.Expect("Password: "); err != nil {
+		t.Fatal(err)
+	}
+	if err := exp.SendLine("secret"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := exp.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "\r" {
+		t.Fatalf("expected sends not to show up in the replayed output, got %q", line)
+	}
+}
+
+func TestVerboseErrors(t *testing.T) {
+	t.Logf("Testing SetVerboseErrors...")
+	exp := mockExpectFromString("Connected to host\r\nlogin as: ")
+	exp.SetVerboseErrors(true)
+	_, err := exp.ExpectRegexFind(`login: (\w+)`)
+	if err == nil {
+		t.Fatal("expected the regex not to be found")
+	}
+	if !strings.Contains(err.Error(), "Output tail:\nConnected to host\r\nlogin as: ") {
+		t.Fatalf("expected the output tail in the error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "prefix of the regex: 'login' at offset 19") {
+		t.Fatalf("expected the matching prefix in the error, got %v", err)
+	}
+}
+
+func TestRegexMatchesPromptAtEnd(t *testing.T) {
+	t.Logf("Testing Regular Expression search for a prompt at the end of the output...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	go pipeWriter.Write([]byte("login: "))
+	matches, _, err := exp.ExpectRegexFindWithOutputTimeout(`(\w+): $`, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches[1] != "login" {
+		t.Fatalf("expected 'login', got %q", matches[1])
+	}
+}
+
+func TestRegexFindMax(t *testing.T) {
+	t.Logf("Testing Regular Expression search with a bounded buffer...")
+	exp := mockExpectFromString(strings.Repeat("x", 10000) + "a1b" + strings.Repeat("y", 10000) + "c2d")
+	exp.SetMaxBufferSize(100)
+	matches, err := exp.ExpectRegexFind(`a(\d)b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches[1] != "1" {
+		t.Fatalf("expected '1', got %q", matches[1])
+	}
+	if _, err := exp.ExpectRegexFindMax(`b[y]+c`, 100); err == nil {
+		t.Fatal("expected a match longer than the buffer not to be found")
+	}
+
+	exp = mockExpectFromString("a" + strings.Repeat("y", 10000) + "b")
+	exp.SetMaxBufferSize(100)
+	if _, err := exp.ExpectRegexFindMax(`a[y]+b`, 0); err != nil {
+		t.Fatalf("expected a per-call limit of 0 to keep everything, got %v", err)
+	}
+}
+
+func TestExpectBetween(t *testing.T) {
+	t.Logf("Testing ExpectBetween...")
+	exp := mockExpectFromString("noise\r\n-----BEGIN-----\r\nline 1\r\nline 2\r\n-----END-----\r\nafter\r\n")
+	block, err := exp.ExpectBetween(`-+BEGIN-+\r\n`, `-+END-+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block != "line 1\r\nline 2\r\n" {
+		t.Fatalf("expected the lines between the markers, got %q", block)
+	}
+	line, err := exp.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "\r" {
+		t.Fatalf("expected the end marker to be consumed, got %q", line)
+	}
+	if _, err := exp.ExpectBetween(`after`, `never`); err == nil {
+		t.Fatal("expected an error when the end marker is missing")
+	}
+}
+
+func TestRegexReleasesConsumedOutput(t *testing.T) {
+	t.Logf("Testing that matched output is released...")
+	exp := mockExpectFromString(strings.Repeat("x", 1<<20) + "END\r\nnext\r\n")
+	if _, err := exp.ExpectRegexFind(`END\r\n`); err != nil {
+		t.Fatal(err)
+	}
+	if c := exp.buf.collection.Cap(); c > maxIdleCapacity {
+		t.Fatalf("expected the matched output to be released, %d bytes still allocated", c)
+	}
+	line, err := exp.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "next\r" {
+		t.Fatalf("expected the output after the match to be kept, got %q", line)
+	}
+}
+
+func TestRegexAcrossReadsWithMaxBufferSize(t *testing.T) {
+	t.Logf("Testing Regular Expression search across reads with a bounded buffer...")
+	var stream bytes.Buffer
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&stream, "%s key=%d;\r\n", strings.Repeat(".", i*7), i)
+	}
+	exp := NewExpectIO(iotest.HalfReader(&stream), ioutil.Discard)
+	exp.SetMaxBufferSize(64)
+	for i := 0; i < 100; i++ {
+		matches, err := exp.ExpectRegexFind(`key=(\d+);`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matches[1] != strconv.Itoa(i) {
+			t.Fatalf("expected key %d, got %q", i, matches[1])
+		}
+	}
+}
+
+func TestRegexMaxBufferSizeDropsPrefix(t *testing.T) {
+	t.Logf("Testing Regular Expression search after megabytes were dropped...")
+	// A 3KB match in the last few KB of 4MB, arriving in pieces that
+	// don't line up with it.
+	stream := strings.Repeat("x", 4<<20) + "BEGIN" + strings.Repeat("-", 3000) + "END" + strings.Repeat("y", 1000)
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		for data := stream; len(data) > 0; {
+			n := 999
+			if n > len(data) {
+				n = len(data)
+			}
+			pipeWriter.Write([]byte(data[:n]))
+			data = data[n:]
+		}
+		pipeWriter.Close()
+	}()
+	exp := NewExpectIO(pipeReader, ioutil.Discard)
+	exp.SetMaxBufferSize(8 << 10)
+	matches, err := exp.ExpectRegexFind(`BEGIN(-+)END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches[1]) != 3000 {
+		t.Fatalf("expected the whole match, got %d bytes of it", len(matches[1]))
+	}
+}
+
+// lineGenerator produces an endless stream of numbered lines without
+// holding them in memory.
+type lineGenerator struct {
+	n    int
+	line []byte
+}
+
+func (g *lineGenerator) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(g.line) == 0 {
+			g.line = []byte(fmt.Sprintf("line %d: ok\r\n", g.n))
+			g.n++
+		}
+		c := copy(p[n:], g.line)
+		g.line = g.line[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// BenchmarkExpectRegexSession matches line after line of an endless
+// session. The time per match must not grow with b.N, e.g. between
+// -benchtime=1000x and -benchtime=1000000x.
+func BenchmarkExpectRegexSession(b *testing.B) {
+	exp := NewExpectIO(&lineGenerator{}, ioutil.Discard)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := exp.ExpectRegexFind(`line (\d+): ok\r\n`); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRegexMatchInBacklog(t *testing.T) {
+	t.Logf("Testing Regular Expression search in output put back...")
+	exp := NewExpectIO(strings.NewReader(""), ioutil.Discard)
+	// The number straddles the first read from the backlog.
+	exp.Unread([]byte(strings.Repeat("x", minReadSize-6) + "id=123456789\r\nnext\r\n"))
+	matches, err := exp.ExpectRegexFind(`id=(\d+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches[1] != "123456789" {
+		t.Fatalf("Expected the whole number, got %q", matches[1])
+	}
+	if line, _ := exp.ReadLine(); line != "\r" {
+		t.Fatalf("Expected the rest of the line left, got %q", line)
+	}
+}
+
+// BenchmarkExpectRegexBacklog matches line after line of b.N lines put
+// back at once, as after a timeout or Unread. The time per match must not
+// grow with b.N either.
+func BenchmarkExpectRegexBacklog(b *testing.B) {
+	var backlog bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		fmt.Fprintf(&backlog, "line %d: ok\r\n", i)
+	}
+	exp := NewExpectIO(strings.NewReader(""), ioutil.Discard)
+	exp.Unread(backlog.Bytes())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := exp.ExpectRegexFind(`line (\d+): ok\r\n`); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestExpectJSON(t *testing.T) {
+	t.Logf("Testing ExpectJSON...")
+	exp := mockExpectFromString(`{"id": 1, "status": "ok"}` + "\n" + `{"id": 2, "status": "busy"}` + "\n$ ")
+	var msg struct {
+		ID     int    `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := exp.ExpectJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 1 || msg.Status != "ok" {
+		t.Fatalf("expected the first message, got %+v", msg)
+	}
+	if err := exp.ExpectJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 2 || msg.Status != "busy" {
+		t.Fatalf("expected the second message, got %+v", msg)
+	}
+	if err := exp.Expect("\n$ "); err != nil {
+		t.Fatalf("expected the output after the JSON to be kept, got %v", err)
+	}
+}
+
+func TestInterleavedReads(t *testing.T) {
+	t.Logf("Testing interleaved ReadLine, Expect, Peek and ExpectRegex...")
+	const input = "alpha 1\r\nbeta 2\r\ngamma 3\r\ndelta 4\r\nepsilon 5\r\nzeta 6\r\n"
+	readers := map[string]func(io.Reader) io.Reader{
+		"whole":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+	}
+	for name, wrap := range readers {
+		exp := NewExpectIO(wrap(strings.NewReader(input)), ioutil.Discard)
+		var seen bytes.Buffer
+		line, err := exp.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen.WriteString(line + "\n")
+		matches, out, err := exp.ExpectRegexFindWithOutput(`beta (\d)\r\n`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matches[1] != "2" {
+			t.Fatalf("%s: expected '2', got %q", name, matches[1])
+		}
+		seen.WriteString(out)
+		peeked, err := exp.Peek(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(peeked) != "gamma" {
+			t.Fatalf("%s: expected to peek 'gamma', got %q", name, peeked)
+		}
+		line, err = exp.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen.WriteString(line + "\n")
+		exp.Capture()
+		if err := exp.Expect("delta 4\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		seen.Write(exp.Collect())
+		matches, out, err = exp.ExpectRegexFindWithOutput(`epsilon (\d)\r\n`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen.WriteString(out)
+		line, err = exp.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen.WriteString(line + "\n")
+		if seen.String() != input {
+			t.Fatalf("%s: expected every byte exactly once, got %q", name, seen.String())
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	t.Logf("Testing String...")
+	exp := mockExpectFromString("hello\r\nworld")
+	if err := exp.Expect("hello"); err != nil {
+		t.Fatal(err)
+	}
+	want := `ExpectIO{buffered: 7, max buffer size: 0, scrollback: false, verbose errors: false, output ended: false}`
+	if got := exp.String(); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	if got := exp.String(); got != want {
+		t.Fatalf("expected String not to change anything, got %s", got)
+	}
+	if _, err := exp.ExpectRegexFind(`never`); err == nil {
+		t.Fatal("expected the regex not to be found")
+	}
+	if got := exp.String(); !strings.Contains(got, "output ended: true") {
+		t.Fatalf("expected the end of output to show, got %s", got)
+	}
+}
+
+// failingWriter accepts at most limit bytes, a few at a time, then fails.
+type failingWriter struct {
+	limit   int
+	written int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if n > 3 {
+		n = 3
+	}
+	if w.written+n > w.limit {
+		n = w.limit - w.written
+		w.written += n
+		return n, errors.New("device gone")
+	}
+	w.written += n
+	return n, nil
+}
+
+func TestSendWriteErrors(t *testing.T) {
+	t.Logf("Testing Send with short and failing writes...")
+	w := &failingWriter{limit: 100}
+	exp := NewExpectIO(strings.NewReader(""), w)
+	if err := exp.SendLine("hello world"); err != nil {
+		t.Fatalf("expected short writes to be retried, got %v", err)
+	}
+	if w.written != 13 {
+		t.Fatalf("expected all 13 bytes written, got %d", w.written)
+	}
+	err := exp.Send(strings.Repeat("x", 100))
+	sendErr, ok := err.(*SendError)
+	if !ok {
+		t.Fatalf("expected a *SendError, got %v", err)
+	}
+	if sendErr.Written != 87 {
+		t.Fatalf("expected 87 bytes written before the failure, got %d", sendErr.Written)
+	}
+}
+
+func TestSendAfterClose(t *testing.T) {
+	t.Logf("Testing Send to a closed child...")
+	input, inputWriter := io.Pipe()
+	exp := NewExpectIO(strings.NewReader(""), inputWriter)
+	input.Close()
+	err := exp.Send("hello\n")
+	if !errors.Is(err, ErrWriteAfterClose) {
+		t.Fatalf("expected ErrWriteAfterClose, got %v", err)
+	}
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("expected the underlying error to be kept, got %v", err)
+	}
+
+	w := &failingWriter{limit: 0}
+	exp = NewExpectIO(strings.NewReader(""), w)
+	if err := exp.Send("x"); errors.Is(err, ErrWriteAfterClose) {
+		t.Fatalf("expected other failures not to count as the child going away, got %v", err)
+	}
+}
+
+func TestSendBytes(t *testing.T) {
+	t.Logf("Testing SendBytes...")
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	exp := NewExpectIO(strings.NewReader(""), w)
+	payload := []byte{0x00, 0xff, 0xfe, 0x80, '\n', 0xc3}
+	n, err := exp.SendBytes(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(payload) {
+		t.Fatalf("Expected %d bytes written, got %d", len(payload), n)
+	}
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Fatalf("Expected the payload flushed unchanged, got %q", out.Bytes())
+	}
+}
+
+func TestRegexFlags(t *testing.T) {
+	t.Logf("Testing Regular Expression search with flags...")
+	exp := mockExpectFromString("BEGIN\r\nfirst\r\nsecond\r\nEND\r\nstatus: OK\r\n")
+	matches, err := exp.ExpectRegexFlags(`BEGIN\r\n(.*)\r\nEND`, syntax.Perl|syntax.DotNL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches[1] != "first\r\nsecond" {
+		t.Fatalf("expected . to match newlines, got %q", matches[1])
+	}
+	matches, err = exp.ExpectRegexFlags(`^status: (ok)\r$`, syntax.Perl&^syntax.OneLine|syntax.FoldCase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches[1] != "OK" {
+		t.Fatalf("expected a case-insensitive multi-line match, got %q", matches[1])
+	}
+}
+
+func TestSetLoggers(t *testing.T) {
+	t.Logf("Testing SetLoggers...")
+	var sent, received bytes.Buffer
+	exp := NewExpectIO(strings.NewReader("login: \r\nwelcome\r\n"), ioutil.Discard)
+	exp.SetLoggers(&sent, &received)
+	if err := exp.Expect("login: "); err != nil {
+		t.Fatal(err)
+	}
+	if err := exp.SendLine("admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := exp.Expect("welcome"); err != nil {
+		t.Fatal(err)
+	}
+	if sent.String() != "admin\r\n" {
+		t.Fatalf("expected only what was sent in the sent log, got %q", sent.String())
+	}
+	if received.String() != "login: \r\nwelcome\r\n" {
+		t.Fatalf("expected only what was received in the received log, got %q", received.String())
+	}
+}
+
+func TestReportTruncated(t *testing.T) {
+	t.Logf("Testing SetReportTruncated...")
+	tests := []struct {
+		input, regex, tail string
+	}{
+		{"copying\r\nprefix: 42 li", `prefix: (\d+) lines\r\n`, "prefix: 42 li"},
+		{"abcab", `abcabd`, "abcab"},
+		{"done\r\ntotal: 1", `(?m)^total: \d+\r$`, "total: 1"},
+		{"copying\r\ndone\r\n", `prefix: (\d+) lines\r\n`, ""},
+		{"xyz", `\Aabc`, ""},
+	}
+	for _, tt := range tests {
+		exp := mockExpectFromString(tt.input)
+		exp.SetReportTruncated(true)
+		_, err := exp.ExpectRegexFind(tt.regex)
+		truncated, ok := err.(*TruncatedError)
+		if tt.tail == "" {
+			if ok || err == nil {
+				t.Errorf("%q in %q: expected a plain not found error, got %v", tt.regex, tt.input, err)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%q in %q: expected a *TruncatedError, got %v", tt.regex, tt.input, err)
+			continue
+		}
+		if truncated.Tail != tt.tail {
+			t.Errorf("%q in %q: expected tail %q, got %q", tt.regex, tt.input, tt.tail, truncated.Tail)
+		}
+	}
+}
+
+func TestMatchWholeLine(t *testing.T) {
+	t.Logf("Testing SetMatchWholeLine...")
+	exp := mockExpectFromString("status: ok (3 items)\nid=7\nnext\nmore\nlast")
+	exp.SetMatchWholeLine(true)
+	_, output, err := exp.ExpectRegexFindWithOutput(`status: (\w+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "status: ok (3 items)\n" {
+		t.Fatalf("Expected the whole line, got %q", output)
+	}
+	if err := exp.Expect("id="); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := exp.ReadLine(); line != "next" {
+		t.Fatalf("Expected the next line to be \"next\", got %q", line)
+	}
+	// A match ending with a newline consumes nothing more.
+	if _, err := exp.ExpectRegexFind(`more\n`); err != nil {
+		t.Fatal(err)
+	}
+	// The last line may end with the output.
+	if _, output, err := exp.ExpectRegexFindWithOutput(`la`); err != nil || output != "last" {
+		t.Fatalf("Expected \"last\", got %q, %v", output, err)
+	}
+}
+
+func TestMatchWholeLinePrompt(t *testing.T) {
+	t.Logf("Testing SetMatchWholeLine with a prompt that no newline follows...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	exp.SetMatchWholeLine(true)
+	go pipeWriter.Write([]byte("login: "))
+	finishesWithin(t, 2*time.Second, func() {
+		if err := exp.ExpectTimeout("login: ", 200*time.Millisecond); err != nil {
+			t.Error(err)
+		}
+	})
+	// The rest of a line still arriving is left for the next search.
+	go pipeWriter.Write([]byte("admin\nPassword: "))
+	if _, output, err := exp.ExpectRegexFindWithOutput(`Password: `); err != nil || output != "admin\nPassword: " {
+		t.Fatalf("Expected the rest of the login line, got %q, %v", output, err)
+	}
+}
+
+func TestMatchAtEOF(t *testing.T) {
+	t.Logf("Testing matches that end exactly at EOF...")
+	readers := map[string]func() io.Reader{
+		"buffer": func() io.Reader { return bytes.NewBufferString("id=42") },
+		// Returns the data together with io.EOF.
+		"data with EOF": func() io.Reader { return iotest.DataErrReader(strings.NewReader("id=42")) },
+	}
+	for name, reader := range readers {
+		exp := NewExpectIO(reader(), ioutil.Discard)
+		if groups, err := exp.ExpectRegexFind(`id=(\d+)`); err != nil || groups[1] != "42" {
+			t.Errorf("%s: ExpectRegexFind: expected 42, got %q, %v", name, groups, err)
+		}
+		exp = NewExpectIO(reader(), ioutil.Discard)
+		if groups, err := exp.ExpectRegexAnchored(`id=(\d+)`); err != nil || groups[1] != "42" {
+			t.Errorf("%s: ExpectRegexAnchored: expected 42, got %q, %v", name, groups, err)
+		}
+		exp = NewExpectIO(reader(), ioutil.Discard)
+		if err := exp.Expect("id=42"); err != nil {
+			t.Errorf("%s: Expect: %v", name, err)
+		}
+		exp = NewExpectIO(reader(), ioutil.Discard)
+		exp.enableScreen(24, 80)
+		if _, err := exp.ExpectScreen(`id=42`); err != nil {
+			t.Errorf("%s: ExpectScreen: %v", name, err)
+		}
+	}
+}
+
+func TestRegexFindContext(t *testing.T) {
+	t.Logf("Testing Regular Expression search with a context...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	go pipeWriter.Write([]byte("loading 1\n"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err := exp.ExpectRegexFindContext(ctx, `ready (\d)`)
+	canceled, ok := err.(*CanceledError)
+	if !ok {
+		t.Fatalf("Expected a *CanceledError, got %v", err)
+	}
+	if canceled.Output != "loading 1\n" || canceled.Err != context.DeadlineExceeded {
+		t.Fatalf("Expected the partial output and the deadline, got %q, %v", canceled.Output, canceled.Err)
+	}
+
+	// Nothing read was lost, not even by the read left waiting.
+	go pipeWriter.Write([]byte("ready 2"))
+	groups, output, err := exp.ExpectRegexFindContext(context.Background(), `ready (\d)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[1] != "2" || output != "loading 1\nready 2" {
+		t.Fatalf("Expected all the output, got %q, %q", groups, output)
+	}
+}
+
+func TestRegexFindContextSilentRetry(t *testing.T) {
+	t.Logf("Testing Regular Expression search with a context timing out twice...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	go pipeWriter.Write([]byte("banner\n"))
+	finishesWithin(t, 2*time.Second, func() {
+		for i := 0; i < 2; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			_, _, err := exp.ExpectRegexFindContext(ctx, `ready`)
+			cancel()
+			if canceled, ok := err.(*CanceledError); !ok || canceled.Output != "banner\n" {
+				t.Errorf("Attempt %d: expected a *CanceledError with the banner, got %v", i+1, err)
+			}
+		}
+	})
+}
+
+// finishesWithin fails the test if f doesn't return within d, so that a
+// search that hangs fails instead of stalling the run.
+func finishesWithin(t *testing.T, d time.Duration, f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatalf("Didn't finish within %v", d)
+	}
+}
+
+func TestTimeoutKeepsOutput(t *testing.T) {
+	t.Logf("Testing that timeouts leave the output read for a retry...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	exp.Capture()
+
+	go pipeWriter.Write([]byte("Password for ad"))
+	err := exp.ExpectTimeout("Password for admin: ", 100*time.Millisecond)
+	if timeoutErr, ok := err.(*TimeoutError); !ok || timeoutErr.Output != "Password for ad" {
+		t.Fatalf("Expected a *TimeoutError with the partial output, got %v", err)
+	}
+	go pipeWriter.Write([]byte("min: "))
+	if err := exp.ExpectTimeout("Password for admin: ", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if captured := string(exp.Collect()); captured != "Password for admin: " {
+		t.Fatalf("Expected the output captured once, got %q", captured)
+	}
+
+	go pipeWriter.Write([]byte("uid=10"))
+	if _, err := exp.ExpectTimeoutRegexFind(`uid=(\d+) `, 100*time.Millisecond); err == nil {
+		t.Fatal("Expected a timeout")
+	}
+	go pipeWriter.Write([]byte("01 "))
+	groups, err := exp.ExpectTimeoutRegexFind(`uid=(\d+) `, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[1] != "1001" {
+		t.Fatalf("Expected 1001, got %q", groups[1])
+	}
+}
+
+func TestSetDebugLogger(t *testing.T) {
+	t.Logf("Testing SetDebugLogger...")
+	var trace []string
+	exp := mockExpectFromString("login: ")
+	exp.SetDebugLogger(func(level, msg string) {
+		trace = append(trace, level+": "+msg)
+	})
+	if _, err := exp.ExpectRegexFind(`login: `); err != nil {
+		t.Fatal(err)
+	}
+	exp.ExpectRegexFind(`password: `)
+	got := strings.Join(trace, "\n")
+	for _, want := range []string{
+		`trace: read 7 bytes: "login: "`,
+		`trace: matching "login: " against 7 bytes`,
+		`debug: matched "login: " at offset 0`,
+		`debug: no match for "password: ": EOF`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q in the trace:\n%s", want, got)
+		}
+	}
+}
+
+func TestTimeoutSilentRetry(t *testing.T) {
+	t.Logf("Testing timeouts retried on a stream that went quiet...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	go pipeWriter.Write([]byte("abc"))
+	finishesWithin(t, 3*time.Second, func() {
+		for i := 0; i < 2; i++ {
+			err := exp.ExpectTimeout("zzz", 100*time.Millisecond)
+			if timeoutErr, ok := err.(*TimeoutError); !ok || timeoutErr.Output != "abc" {
+				t.Errorf("ExpectTimeout attempt %d: expected a *TimeoutError with abc, got %v", i+1, err)
+			}
+		}
+		if _, _, err := exp.ExpectRegexFindWithOutputTimeout(`zzz`, 100*time.Millisecond); err == nil {
+			t.Error("ExpectRegexFindWithOutputTimeout: expected a timeout")
+		}
+		if i, _, err := exp.ExpectSwitch(100*time.Millisecond, ExpectCase{Pattern: `zzz`}); i != -1 || err == nil {
+			t.Errorf("ExpectSwitch: expected a timeout, got %d %v", i, err)
+		}
+		if err := exp.ExpectAll(100*time.Millisecond, `zzz`); err == nil {
+			t.Error("ExpectAll: expected a timeout")
+		}
+	})
+}
+
+func TestRegexFindBuffered(t *testing.T) {
+	t.Logf("Testing ExpectRegexFindBuffered...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	finishesWithin(t, 5*time.Second, func() {
+		// Nothing is at hand yet, and nothing is read.
+		if groups, matched := exp.ExpectRegexFindBuffered(`id=(\d+)`); matched || groups != nil {
+			t.Errorf("Expected no match, got %q", groups)
+		}
+		go pipeWriter.Write([]byte("status: busy\nid=42 ok\n"))
+		if err := exp.Expect("status:"); err != nil {
+			t.Error(err)
+		}
+		if _, matched := exp.ExpectRegexFindBuffered(`done`); matched {
+			t.Error("Expected no match for output that never came")
+		}
+		groups, matched := exp.ExpectRegexFindBuffered(`id=(\d+)`)
+		if !matched || groups[1] != "42" {
+			t.Errorf("Expected 42, got %q %v", groups, matched)
+		}
+		if line, err := exp.ReadLine(); err != nil || line != " ok" {
+			t.Errorf("Expected the rest of the output, got %q %v", line, err)
+		}
+	})
+}
+
+func TestRegexFindLast(t *testing.T) {
+	t.Logf("Testing ExpectRegexFindLast...")
+	exp := mockExpectFromString("[1]$ ls\r\n[2]$ \r\n[3]$ pwd\r\n/root\r\n")
+	groups, err := exp.ExpectRegexFindLast(`\[(\d)\]\$ `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[1] != "3" {
+		t.Fatalf("Expected the last prompt, got %q", groups)
+	}
+	if line, _ := exp.ReadLine(); line != "pwd\r" {
+		t.Fatalf("Expected the output after the last prompt, got %q", line)
+	}
+
+	// Output still to come is not waited for.
+	pipeReader, pipeWriter := io.Pipe()
+	exp = NewExpectIO(pipeReader, nil)
+	go pipeWriter.Write([]byte("$ $ "))
+	finishesWithin(t, 5*time.Second, func() {
+		if groups, err := exp.ExpectRegexFindLast(`\$ `); err != nil || groups[0] != "$ " {
+			t.Errorf("Expected a prompt, got %q %v", groups, err)
+		}
+		if exp.HasPending() {
+			t.Error("Expected both prompts to be consumed")
+		}
+	})
+}
+
+func TestRegexFindAfter(t *testing.T) {
+	t.Logf("Testing ExpectRegexFindAfter...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	finishesWithin(t, 5*time.Second, func() {
+		go pipeWriter.Write([]byte("ready\r\n$ "))
+		if err := exp.Expect("ready"); err != nil {
+			t.Error(err)
+		}
+		// The old prompt is still buffered when the mark is taken.
+		mark := exp.Mark()
+		go pipeWriter.Write([]byte("result\r\n$ "))
+		groups, err := exp.ExpectRegexFindAfter(`(?s)(.*)\$ `, mark)
+		if err != nil || groups[1] != "result\r\n" {
+			t.Errorf("Expected the output after the mark, got %q %v", groups, err)
+		}
+
+		// A mark already passed skips nothing.
+		mark = exp.Mark()
+		go pipeWriter.Write([]byte("next\r\n"))
+		if err := exp.Expect("ne"); err != nil {
+			t.Error(err)
+		}
+		if groups, err := exp.ExpectRegexFindAfter(`(\w+)`, mark); err != nil || groups[1] != "xt" {
+			t.Errorf("Expected the rest of the output, got %q %v", groups, err)
+		}
+	})
+}
+
+func TestReadLineTimeout(t *testing.T) {
+	t.Logf("Testing ReadLineTimeout...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	go pipeWriter.Write([]byte("first\nsecond, no newline yet"))
+	finishesWithin(t, 5*time.Second, func() {
+		if line, err := exp.ReadLineTimeout(time.Second); err != nil || line != "first" {
+			t.Errorf("Expected the first line, got %q %v", line, err)
+		}
+		line, err := exp.ReadLineTimeout(100 * time.Millisecond)
+		if _, ok := err.(*TimeoutError); !ok || line != "second, no newline yet" {
+			t.Errorf("Expected a *TimeoutError with the partial line, got %q %v", line, err)
+		}
+		go pipeWriter.Write([]byte("\nthird;"))
+		// The partial line was left for the next call.
+		if line, err := exp.ReadLineTimeout(time.Second); err != nil || line != "second, no newline yet" {
+			t.Errorf("Expected the whole second line, got %q %v", line, err)
+		}
+		if data, err := exp.ReadUntilTimeout(';', time.Second); err != nil || string(data) != "third" {
+			t.Errorf("Expected the data up to the delimiter, got %q %v", data, err)
+		}
+		pipeWriter.Close()
+		if _, err := exp.ReadUntilTimeout(';', time.Second); err != io.EOF {
+			t.Errorf("Expected io.EOF, got %v", err)
+		}
+	})
+}
+
+func TestExpectWord(t *testing.T) {
+	t.Logf("Testing ExpectWord...")
+	exp := mockExpectFromString("status: broken\r\nstatus: ok\r\n[+] done.\r\n")
+	if err := exp.ExpectWord("ok"); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := exp.ReadLine(); line != "\r" {
+		t.Fatalf("Expected the match on the second line, got %q left", line)
+	}
+	if err := exp.ExpectWord("[+] done."); err != nil {
+		t.Fatal(err)
+	}
+	if err := exp.ExpectWord(""); err != ErrEmptySearch {
+		t.Fatalf("Expected ErrEmptySearch, got %v", err)
+	}
+	exp = mockExpectFromString("tokens: broken okay\r\n")
+	if err := exp.ExpectWord("ok"); err == nil {
+		t.Fatal("Expected no match inside other words")
+	}
+}
+
+func TestSinceLastMatch(t *testing.T) {
+	t.Logf("Testing SinceLastMatch...")
+	exp := mockExpectFromString("$ ls\r\na b\r\n$ pwd\r\n/root\r\n$ ")
+	if exp.SinceLastMatch() != "" {
+		t.Fatalf("Expected nothing before the first match, got %q", exp.SinceLastMatch())
+	}
+	if err := exp.Expect("$ "); err != nil {
+		t.Fatal(err)
+	}
+	if exp.SinceLastMatch() != "$ " {
+		t.Fatalf("Expected the first prompt, got %q", exp.SinceLastMatch())
+	}
+	if _, err := exp.ExpectRegexFind(`\$ `); err != nil {
+		t.Fatal(err)
+	}
+	if exp.SinceLastMatch() != "ls\r\na b\r\n$ " {
+		t.Fatalf("Expected the output of ls, got %q", exp.SinceLastMatch())
+	}
+	if err := exp.Expect("$ "); err != nil {
+		t.Fatal(err)
+	}
+	if exp.SinceLastMatch() != "pwd\r\n/root\r\n$ " {
+		t.Fatalf("Expected the output of pwd, got %q", exp.SinceLastMatch())
+	}
+	// A failed search leaves it alone.
+	exp.ExpectRegexFind(`never`)
+	if exp.SinceLastMatch() != "pwd\r\n/root\r\n$ " {
+		t.Fatalf("Expected the last match to be kept, got %q", exp.SinceLastMatch())
+	}
+}
+
+func TestExpectExactlyOnce(t *testing.T) {
+	t.Logf("Testing ExpectExactlyOnce...")
+	exp := mockExpectFromString("mounted /data\r\n$ mounted /data\r\nmounted /data\r\n$ $ ")
+	groups, err := exp.ExpectExactlyOnce(`mounted (\S+)`, `\$ `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[1] != "/data" {
+		t.Fatalf("Expected /data, got %q", groups)
+	}
+	if _, err := exp.ExpectExactlyOnce(`mounted (\S+)`, `\$ `); err == nil || !strings.Contains(err.Error(), "2 times") {
+		t.Fatalf("Expected the duplicate to be reported, got %v", err)
+	}
+	if _, err := exp.ExpectExactlyOnce(`mounted (\S+)`, `\$ `); err == nil || !strings.Contains(err.Error(), "0 times") {
+		t.Fatalf("Expected the missing match to be reported, got %v", err)
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	t.Logf("Testing SetMaxLineLength...")
+	exp := mockExpectFromString("abcdefghij\nwxyz\n")
+	exp.SetMaxLineLength(4)
+	for _, want := range []struct {
+		line string
+		err  error
+	}{
+		{"abcd", ErrLineTooLong},
+		{"efgh", ErrLineTooLong},
+		{"ij", nil},
+		{"wxyz", nil},
+	} {
+		line, err := exp.ReadLine()
+		if line != want.line || err != want.err {
+			t.Fatalf("Expected %q %v, got %q %v", want.line, want.err, line, err)
+		}
+	}
+}
+
+func TestExpectBetweenTimeout(t *testing.T) {
+	t.Logf("Testing ExpectBetweenTimeout...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	finishesWithin(t, 5*time.Second, func() {
+		go pipeWriter.Write([]byte("noise\r\n"))
+		_, err := exp.ExpectBetweenTimeout(`BEGIN\r\n`, `END`, 100*time.Millisecond)
+		if timeout, ok := err.(*TimeoutError); !ok || timeout.Pattern != `BEGIN\r\n` {
+			t.Errorf("Expected a timeout waiting for the start, got %v", err)
+		}
+		go pipeWriter.Write([]byte("BEGIN\r\nline 1\r\n"))
+		block, err := exp.ExpectBetweenTimeout(`BEGIN\r\n`, `END`, 100*time.Millisecond)
+		if timeout, ok := err.(*TimeoutError); !ok || timeout.Pattern != `END` || block != "line 1\r\n" {
+			t.Errorf("Expected a timeout waiting for the end with the partial block, got %q %v", block, err)
+		}
+		go pipeWriter.Write([]byte("line 2\r\nEND\r\n"))
+		// The partial block was left, so the end can still be waited for.
+		block, err = exp.ExpectBetweenTimeout(``, `END`, time.Second)
+		if err != nil || block != "line 1\r\nline 2\r\n" {
+			t.Errorf("Expected the rest of the block, got %q %v", block, err)
+		}
+	})
+}
+
+func TestLastMatchFromBuffer(t *testing.T) {
+	t.Logf("Testing LastMatchFromBuffer...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	finishesWithin(t, 5*time.Second, func() {
+		go pipeWriter.Write([]byte("first\nsecond\n"))
+		if err := exp.Expect("first"); err != nil || exp.LastMatchFromBuffer() {
+			t.Errorf("Expected a match that needed a read, got %v %v", exp.LastMatchFromBuffer(), err)
+		}
+		if _, err := exp.ExpectRegexFind(`second`); err != nil || !exp.LastMatchFromBuffer() {
+			t.Errorf("Expected a match from the buffer, got %v %v", exp.LastMatchFromBuffer(), err)
+		}
+		go pipeWriter.Write([]byte("third\n"))
+		if _, err := exp.ExpectRegexFind(`third`); err != nil || exp.LastMatchFromBuffer() {
+			t.Errorf("Expected a match that needed a read, got %v %v", exp.LastMatchFromBuffer(), err)
+		}
+	})
+}
+
+func TestExpectLineRegex(t *testing.T) {
+	t.Logf("Testing ExpectLineRegex...")
+	exp := mockExpectFromString("old status: ok\nstatus: ok\nstatus: done\r\nstatus: cut")
+	for _, want := range []string{"ok", "done"} {
+		groups, err := exp.ExpectLineRegex(`status: (\w+)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if groups[0] != "status: "+want || groups[1] != want {
+			t.Fatalf("Expected the line with %q, got %q", want, groups)
+		}
+	}
+	if _, err := exp.ExpectLineRegex(`status: (\w+)`); err == nil {
+		t.Fatal("Expected a line without its ending not to match")
+	}
+
+	// Groups and "$" at the end of a line as a PTY sends it.
+	for _, regex := range []string{`value: (.*)`, `value: (\d+)$`} {
+		exp = mockExpectFromString("value: 42\r\nnext\r\n")
+		groups, err := exp.ExpectLineRegex(regex)
+		if err != nil {
+			t.Fatalf("%s: %v", regex, err)
+		}
+		if groups[0] != "value: 42" || groups[1] != "42" {
+			t.Fatalf("%s: expected 42 without the line ending, got %q", regex, groups)
+		}
+	}
+	exp = mockExpectFromString("price: 5$\r\n")
+	if groups, err := exp.ExpectLineRegex(`price: (\d+)\$`); err != nil || groups[1] != "5" {
+		t.Fatalf("Expected an escaped $ to stay literal, got %q %v", groups, err)
+	}
+}
+
+func TestRegexFindOrDefault(t *testing.T) {
+	t.Logf("Testing ExpectRegexFindOrDefault...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	go pipeWriter.Write([]byte("name: web\n"))
+	finishesWithin(t, 5*time.Second, func() {
+		if groups, matched := exp.ExpectRegexFindOrDefault(`version: (\S+)`, 100*time.Millisecond); matched || groups != nil {
+			t.Errorf("Expected no match, got %q", groups)
+		}
+		groups, matched := exp.ExpectRegexFindOrDefault(`name: (\S+)`, time.Second)
+		if !matched || groups[1] != "web" {
+			t.Errorf("Expected web, got %q %v", groups, matched)
+		}
+		// Nothing more arrives.
+		if _, matched := exp.ExpectRegexFindOrDefault(`port: (\d+)`, 100*time.Millisecond); matched {
+			t.Error("Expected no match on a quiet stream")
+		}
+		pipeWriter.Close()
+		if _, matched := exp.ExpectRegexFindOrDefault(`port: (\d+)`, time.Second); matched {
+			t.Error("Expected no match at the end of the output")
+		}
+	})
+}
+
+func TestRegexFindPos(t *testing.T) {
+	t.Logf("Testing ExpectRegexFindPos...")
+	exp := NewExpectIO(strings.NewReader("abc 12 def 345 rest\n"), nil)
+	groups, consumed, err := exp.ExpectRegexFindPos(`\d+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[0] != "12" || consumed != len("abc 12") {
+		t.Fatalf("Expected 12 after 6 bytes, got %q after %d", groups, consumed)
+	}
+	groups, consumed, err = exp.ExpectRegexFindPos(`\d+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[0] != "345" || consumed != len(" def 345") {
+		t.Fatalf("Expected 345 after 8 bytes, got %q after %d", groups, consumed)
+	}
+	if _, consumed, err := exp.ExpectRegexFindPos(`\d+`); err == nil || consumed != 0 {
+		t.Fatalf("Expected no match at the end of the output, got %d bytes and %v", consumed, err)
+	}
+
+	// Output dropped to keep the buffer small is still counted.
+	stream := strings.Repeat("x", 100000) + "END"
+	exp = NewExpectIO(strings.NewReader(stream), nil)
+	exp.SetMaxBufferSize(1024)
+	if _, consumed, err = exp.ExpectRegexFindPos(`END`); err != nil {
+		t.Fatal(err)
+	}
+	if consumed != len(stream) {
+		t.Fatalf("Expected %d bytes consumed, got %d", len(stream), consumed)
+	}
+}
+
+func TestWaitReadable(t *testing.T) {
+	t.Logf("Testing WaitReadable...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	finishesWithin(t, 5*time.Second, func() {
+		if ready, err := exp.WaitReadable(50 * time.Millisecond); ready || err != nil {
+			t.Errorf("Expected nothing to read yet, got %v %v", ready, err)
+		}
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			pipeWriter.Write([]byte("hello\n"))
+		}()
+		if ready, err := exp.WaitReadable(time.Second); !ready || err != nil {
+			t.Errorf("Expected output to read, got %v %v", ready, err)
+		}
+		// Waiting again consumes nothing.
+		if ready, _ := exp.WaitReadable(0); !ready {
+			t.Error("Expected the output to still be there")
+		}
+		if line, err := exp.ReadLine(); err != nil || line != "hello" {
+			t.Errorf("Expected hello, got %q %v", line, err)
+		}
+		pipeWriter.Close()
+		if ready, err := exp.WaitReadable(time.Second); ready || err != io.EOF {
+			t.Errorf("Expected the end of the output, got %v %v", ready, err)
+		}
+	})
+}
+
+func TestRegexTimed(t *testing.T) {
+	t.Logf("Testing timed Regular Expression search...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		pipeWriter.Write([]byte("router> "))
+	}()
+	matches, elapsed, err := exp.ExpectRegexTimed(`(\w+)> `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches[1] != "router" {
+		t.Fatalf("expected 'router', got %q", matches[1])
+	}
+	if elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("expected the time until the prompt appeared, got %v", elapsed)
+	}
+}
+
+// countingReader serves data in a single read and counts every read.
+type countingReader struct {
+	data  []byte
+	reads int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestNoReadWhenMatchBuffered(t *testing.T) {
+	t.Logf("Testing that buffered matches don't read...")
+	r := &countingReader{data: []byte("one\r\ntwo 2\r\nthree\r\nfour\r\n$ ")}
+	exp := NewExpectIO(r, ioutil.Discard)
+	if err := exp.Expect("one"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exp.ExpectRegexFind(`two (\d)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := exp.ExpectAnyResult(`three`, `four`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exp.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exp.ExpectRegexFind(`\$ $`); err != nil {
+		t.Fatal(err)
+	}
+	if r.reads != 1 {
+		t.Fatalf("expected matches in buffered output not to read again, read %d times", r.reads)
+	}
+}
+
+func TestSendConfirm(t *testing.T) {
+	t.Logf("Testing SendConfirm...")
+	exp := NewExpectIO(strings.NewReader("reboot"), ioutil.Discard)
+	if err := exp.SendConfirm("reboot", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	exp = NewExpectIO(strings.NewReader("rebo"), ioutil.Discard)
+	if err := exp.SendConfirm("reboot", time.Second); err == nil {
+		t.Fatal("expected a missing echo to be reported")
+	}
+}
+
+func TestExpectFirst(t *testing.T) {
+	t.Logf("Testing ExpectFirst...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	go pipeWriter.Write([]byte("Password: "))
+	i, groups, err := exp.ExpectFirst(time.Second, `(\w+)> `, `(Password): `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 1 || groups[1] != "Password" {
+		t.Fatalf("expected the password prompt, got %d %q", i, groups)
+	}
+	i, _, err = exp.ExpectFirst(100*time.Millisecond, `(\w+)> `)
+	if _, ok := err.(*TimeoutError); !ok || i != -1 {
+		t.Fatalf("expected -1 and a *TimeoutError, got %d %v", i, err)
+	}
+	if _, _, err := exp.ExpectFirst(time.Second, ``); err != ErrEmptySearch {
+		t.Fatalf("expected an empty pattern to be rejected, got %v", err)
+	}
+	if i, _, err := exp.ExpectFirst(time.Second); err != ErrEmptySearch || i != -1 {
+		t.Fatalf("expected -1 and ErrEmptySearch without patterns, got %d %v", i, err)
+	}
+}
+
+func TestOnLine(t *testing.T) {
+	t.Logf("Testing OnLine...")
+	exp := NewExpectIO(iotest.HalfReader(strings.NewReader("step 1\r\nstep 2\r\nstep 3\ndone\r\n$ ")), ioutil.Discard)
+	var lines []string
+	exp.OnLine(func(line string) {
+		lines = append(lines, line)
+	})
+	if _, err := exp.ExpectRegexFind(`done`); err != nil {
+		t.Fatal(err)
+	}
+	if err := exp.Expect("$ "); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(lines, "|"); got != "step 1|step 2|step 3|done" {
+		t.Fatalf("expected every complete line once, got %q", got)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	t.Logf("Testing WaitReady...")
+	probes, probeWriter := io.Pipe()
+	replies, replyWriter := io.Pipe()
+	exp := NewExpectIO(replies, probeWriter)
+	// The service answers from the third probe on.
+	go func() {
+		lines := bufio.NewScanner(probes)
+		for n := 1; lines.Scan(); n++ {
+			if n >= 3 {
+				replyWriter.Write([]byte("pong\n"))
+			}
+		}
+	}()
+	if err := exp.WaitReady("ping\n", "pong", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// A service that prints a banner and then nothing more.
+	silent, banner := io.Pipe()
+	exp = NewExpectIO(silent, ioutil.Discard)
+	go banner.Write([]byte("service v1.2\n"))
+	finishesWithin(t, 3*time.Second, func() {
+		err := exp.WaitReady("ping\n", "pong", 600*time.Millisecond)
+		if timeoutErr, ok := err.(*TimeoutError); !ok || timeoutErr.Output != "service v1.2\n" {
+			t.Errorf("Expected a *TimeoutError with the banner, got %v", err)
+		}
+	})
+}
+
+func TestExpectNothing(t *testing.T) {
+	t.Logf("Testing ExpectNothing...")
+	pipeReader, pipeWriter := io.Pipe()
+	exp := NewExpectIO(pipeReader, nil)
+	go pipeWriter.Write([]byte("$ "))
+	if err := exp.Expect("$ "); err != nil {
+		t.Fatal(err)
+	}
+	if err := exp.ExpectNothing(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// Output arriving after the window must still be read by the next
+	// call, and output arriving within it must be reported.
+	go pipeWriter.Write([]byte("late\r\n"))
+	if err := exp.Expect("late\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	go pipeWriter.Write([]byte("segfault\r\n"))
+	err := exp.ExpectNothing(5 * time.Second)
+	if err == nil || !strings.Contains(err.Error(), "segfault") {
+		t.Fatalf("expected the unexpected output in the error, got %v", err)
+	}
+	line, err := exp.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "segfault\r" {
+		t.Fatalf("expected the unexpected output to be left unread, got %q", line)
+	}
+}
+
+func TestRegexFindSubmatchIndex(t *testing.T) {
+	t.Logf("Testing Regular Expression search for submatch offsets...")
+	exp := mockExpectFromString("boot\r\nuser=ünïcode id=7\r\n")
+	loc, output, err := exp.ExpectRegexFindSubmatchIndex(`user=(\S+) (?:gid=(\d+)|id=(\d+))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loc) != 8 {
+		t.Fatalf("expected offsets for the match and 3 groups, got %v", loc)
+	}
+	if output[loc[2]:loc[3]] != "ünïcode" || output[loc[6]:loc[7]] != "7" {
+		t.Fatalf("expected the offsets to slice the groups out of %q, got %v", output, loc)
+	}
+	if loc[4] != -1 || loc[5] != -1 {
+		t.Fatalf("expected -1 for the group that didn't match, got %v", loc)
+	}
+	if output[:loc[0]] != "boot\r\n" {
+		t.Fatalf("expected the output before the match to be included, got %q", output)
+	}
+}
@@ -0,0 +1,64 @@
+package gexpect
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// ExpectMux waits on several streams at once, e.g. one per child process,
+// for whichever of them produces a pattern first.
+type ExpectMux struct {
+	streams []*ExpectIO
+}
+
+func NewExpectMux(streams ...*ExpectIO) *ExpectMux {
+	return &ExpectMux{streams: streams}
+}
+
+// Add adds a stream to the mux and returns its index.
+func (mux *ExpectMux) Add(stream *ExpectIO) int {
+	mux.streams = append(mux.streams, stream)
+	return len(mux.streams) - 1
+}
+
+// Wait waits until regex matches on any of the streams and returns the
+// index of that stream along with the groups of the match. Streams that
+// end without a match are skipped; an error is returned once all of them
+// have ended.
+func (mux *ExpectMux) Wait(regex string) (int, []string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return -1, nil, err
+	}
+	type found struct {
+		which int
+		regexFindResult
+	}
+	results := make(chan found, len(mux.streams))
+	done := make(chan struct{})
+	for i, stream := range mux.streams {
+		go func(i int, stream *ExpectIO) {
+			results <- found{i, <-stream.goRegexFindIndex(re, done)}
+		}(i, stream)
+	}
+	// The searches still going once one matches are stopped, and waited
+	// for, so that they leave their output to later calls. So does one
+	// that matched too late.
+	winner := -1
+	var groups []string
+	for range mux.streams {
+		f := <-results
+		switch {
+		case f.err != nil:
+		case winner < 0:
+			winner, groups = f.which, submatches(f.out, f.pairs)
+			close(done)
+		default:
+			mux.streams[f.which].buf.PutBack([]byte(f.out))
+		}
+	}
+	if winner < 0 {
+		return -1, nil, fmt.Errorf("ExpectMux didn't find regex '%v' on any stream.", regex)
+	}
+	return winner, groups, nil
+}
@@ -0,0 +1,55 @@
+package gexpect
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestExpectMux(t *testing.T) {
+	t.Logf("Testing ExpectMux...")
+	slowReader, slowWriter := io.Pipe()
+	fastReader, fastWriter := io.Pipe()
+	slow := NewExpectIO(slowReader, nil)
+	mux := NewExpectMux(slow)
+	if i := mux.Add(NewExpectIO(fastReader, nil)); i != 1 {
+		t.Fatalf("expected the second stream to get index 1, got %d", i)
+	}
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		slowWriter.Write([]byte("slow ready\r\n$ "))
+	}()
+	go fastWriter.Write([]byte("fast ready\r\n$ "))
+
+	which, groups, err := mux.Wait(`(\w+) ready`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if which != 1 || groups[1] != "fast" {
+		t.Fatalf("expected the fast stream to win, got %d %q", which, groups)
+	}
+	// The losing stream keeps its output.
+	if groups, err := slow.ExpectRegexFind(`(\w+) ready`); err != nil || groups[1] != "slow" {
+		t.Fatalf("expected the slow stream's output, got %q %v", groups, err)
+	}
+
+	// A stream that has gone quiet with output left over doesn't hold up
+	// the others.
+	quietReader, quietWriter := io.Pipe()
+	quiet := NewExpectIO(quietReader, nil)
+	go quietWriter.Write([]byte("starting\r\n"))
+	quiet.ExpectTimeout("ready", 100*time.Millisecond)
+	mux = NewExpectMux(quiet, mockExpectFromString("one ready\r\ntwo ready\r\n"))
+	finishesWithin(t, 3*time.Second, func() {
+		for i := 0; i < 2; i++ {
+			if which, _, err := mux.Wait(`(\w+) ready`); err != nil || which != 1 {
+				t.Errorf("expected the second stream to match, got %d %v", which, err)
+			}
+		}
+	})
+
+	mux = NewExpectMux(mockExpectFromString("nothing"), mockExpectFromString("here"))
+	if _, _, err := mux.Wait(`ready`); err == nil {
+		t.Fatal("expected an error once all streams ended")
+	}
+}
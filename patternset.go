@@ -0,0 +1,44 @@
+package gexpect
+
+import "sort"
+
+// PatternSet is a fixed set of named regexes compiled once, for protocols
+// with a known vocabulary of messages that are expected over and over.
+type PatternSet struct {
+	names []string
+	alt   *alternation
+}
+
+// NewPatternSet compiles patterns, a map from names to regexes. If several
+// match at the same place, the first name in sorted order wins. An empty
+// set fails with ErrEmptySearch.
+func NewPatternSet(patterns map[string]string) (*PatternSet, error) {
+	if len(patterns) == 0 {
+		return nil, ErrEmptySearch
+	}
+	names := make([]string, 0, len(patterns))
+	for name := range patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	regexes := make([]string, len(names))
+	for i, name := range names {
+		regexes[i] = patterns[name]
+	}
+	alt, err := compileAlternation(regexes)
+	if err != nil {
+		return nil, err
+	}
+	return &PatternSet{names, alt}, nil
+}
+
+// ExpectSet waits for whichever pattern of set appears first in the output
+// and returns its name along with its match and submatches.
+func (expect *ExpectIO) ExpectSet(set *PatternSet) (name string, groups []string, err error) {
+	pairs, out, err := expect.expectRegexFindIndex(set.alt.re)
+	if err != nil {
+		return "", nil, err
+	}
+	i := set.alt.which(pairs)
+	return set.names[i], set.alt.submatches(out, pairs, i), nil
+}
@@ -0,0 +1,45 @@
+package gexpect
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpectSet(t *testing.T) {
+	t.Logf("Testing ExpectSet...")
+	set, err := NewPatternSet(map[string]string{
+		"ok":    `OK\r\n`,
+		"error": `ERROR (\d+)\r\n`,
+		"ring":  `RING\r\n`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := mockExpectFromString("AT\r\nRING\r\nERROR 3\r\nOK\r\n")
+	tests := []struct {
+		name   string
+		groups []string
+	}{
+		{"ring", []string{"RING\r\n"}},
+		{"error", []string{"ERROR 3\r\n", "3"}},
+		{"ok", []string{"OK\r\n"}},
+	}
+	for _, tt := range tests {
+		name, groups, err := exp.ExpectSet(set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != tt.name || strings.Join(groups, "|") != strings.Join(tt.groups, "|") {
+			t.Fatalf("expected %s %q, got %s %q", tt.name, tt.groups, name, groups)
+		}
+	}
+	if _, _, err := exp.ExpectSet(set); err == nil {
+		t.Fatal("expected an error once the output ends")
+	}
+	if _, err := NewPatternSet(map[string]string{"bad": `(`}); err == nil {
+		t.Fatal("expected an invalid regex to be rejected")
+	}
+	if _, err := NewPatternSet(map[string]string{}); err != ErrEmptySearch {
+		t.Fatalf("expected an empty set to be rejected, got %v", err)
+	}
+}
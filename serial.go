@@ -0,0 +1,103 @@
+// +build !windows
+
+package gexpect
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Parity is the parity checking of a serial line.
+type Parity int
+
+const (
+	ParityNone Parity = iota
+	ParityOdd
+	ParityEven
+)
+
+// SerialConfig describes the line settings of a serial port. Zero values
+// of DataBits and StopBits mean 8 and 1.
+type SerialConfig struct {
+	Baud     int
+	DataBits int
+	Parity   Parity
+	StopBits int
+}
+
+// SpawnSerial opens the serial port device, e.g. /dev/ttyUSB0, at baud with
+// 8 data bits, no parity and 1 stop bit, for talking to hardware. There is
+// no child process: Close and CloseAndWait close the port, and Wait
+// returns at once.
+func SpawnSerial(device string, baud int) (*ExpectSubprocess, error) {
+	return SpawnSerialConfig(device, SerialConfig{Baud: baud})
+}
+
+// SpawnSerialConfig is like SpawnSerial with all line settings given. The
+// port is put in raw mode, so that bytes pass through unchanged.
+func SpawnSerialConfig(device string, config SerialConfig) (*ExpectSubprocess, error) {
+	// O_NONBLOCK keeps the open from waiting for a carrier, and lets
+	// read deadlines work.
+	f, err := os.OpenFile(device, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := configureSerial(f, config); err != nil {
+		f.Close()
+		return nil, err
+	}
+	expect := &ExpectSubprocess{ptmx: f, closer: f}
+	expect.ExpectIO.buf = new(buffer)
+	expect.ExpectIO.buf.attach(ptyReader{f}, f)
+	return expect, nil
+}
+
+func configureSerial(f *os.File, config SerialConfig) error {
+	termios, err := getTermios(f)
+	if err != nil {
+		return err
+	}
+	// Raw mode, as cfmakeraw sets it.
+	termios.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	termios.Oflag &^= syscall.OPOST
+	termios.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	termios.Cflag |= syscall.CREAD | syscall.CLOCAL
+	termios.Cc[syscall.VMIN] = 1
+	termios.Cc[syscall.VTIME] = 0
+
+	termios.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.PARODD | syscall.CSTOPB
+	switch config.DataBits {
+	case 5:
+		termios.Cflag |= syscall.CS5
+	case 6:
+		termios.Cflag |= syscall.CS6
+	case 7:
+		termios.Cflag |= syscall.CS7
+	case 0, 8:
+		termios.Cflag |= syscall.CS8
+	default:
+		return errors.New("gexpect: data bits must be between 5 and 8")
+	}
+	switch config.Parity {
+	case ParityNone:
+	case ParityOdd:
+		termios.Cflag |= syscall.PARENB | syscall.PARODD
+	case ParityEven:
+		termios.Cflag |= syscall.PARENB
+	default:
+		return errors.New("gexpect: unknown parity")
+	}
+	switch config.StopBits {
+	case 0, 1:
+	case 2:
+		termios.Cflag |= syscall.CSTOPB
+	default:
+		return errors.New("gexpect: stop bits must be 1 or 2")
+	}
+	if err := setSpeed(termios, config.Baud); err != nil {
+		return err
+	}
+	return setTermios(f, termios)
+}
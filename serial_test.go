@@ -0,0 +1,48 @@
+// +build !windows
+
+package gexpect
+
+import (
+	"bufio"
+	"testing"
+	"time"
+
+	"github.com/kr/pty"
+)
+
+func TestSpawnSerial(t *testing.T) {
+	t.Logf("Testing SpawnSerial... ")
+	// The slave side of a PTY stands in for the serial port, with the
+	// master playing the device.
+	device, port, err := pty.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	defer port.Close()
+	serial, err := SpawnSerialConfig(port.Name(), SerialConfig{Baud: 115200, DataBits: 7, Parity: ParityEven, StopBits: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serial.Close()
+
+	go device.Write([]byte("U-Boot> "))
+	if err := serial.ExpectTimeout("U-Boot> ", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := serial.Send("version\r"); err != nil {
+		t.Fatal(err)
+	}
+	// Raw mode must pass the carriage return through untranslated.
+	line, err := bufio.NewReader(device).ReadString('\r')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "version\r" {
+		t.Fatalf("expected the command on the device, got %q", line)
+	}
+
+	if _, err := SpawnSerial(port.Name(), 12345); err == nil {
+		t.Fatal("expected an unsupported baud rate to be rejected")
+	}
+}
@@ -0,0 +1,91 @@
+package gexpect
+
+import (
+	"io"
+	"regexp"
+	"regexp/syntax"
+)
+
+// SetLinePrefixStrip removes whatever regex matches at the start of each
+// line of output before it is matched against, e.g. timestamps or log
+// level tags a device puts in front of every line. Loggers and mirrors
+// still get the raw output. The start of a line is held back only while
+// regex could still match it, and is stripped as soon as it does, so
+// regex should end in something definite, such as the "] " of a tag. An
+// empty regex turns stripping off. Output already read ahead is kept as it
+// was.
+func (expect *ExpectIO) SetLinePrefixStrip(regex string) error {
+	if regex == "" {
+		expect.buf.linePrefix = nil
+	} else {
+		re, err := regexp.Compile(`\A(?:` + regex + `)`)
+		if err != nil {
+			return err
+		}
+		prog, err := compileProg(re)
+		if err != nil {
+			return err
+		}
+		expect.buf.linePrefix = &linePrefix{re, prog}
+	}
+	expect.buf.resetReader()
+	return nil
+}
+
+type linePrefix struct {
+	re   *regexp.Regexp
+	prog *syntax.Prog // of re, to tell whether it may still match
+}
+
+// prefixStripper removes the matches of prefix at the start of each line
+// read from r.
+type prefixStripper struct {
+	r           io.Reader
+	prefix      *linePrefix
+	atLineStart bool
+	pending     []byte // start of a line that re may still match
+	out         []byte
+	err         error
+}
+
+func (s *prefixStripper) Read(p []byte) (int, error) {
+	for len(s.out) == 0 && s.err == nil {
+		chunk := make([]byte, len(p))
+		n, err := s.r.Read(chunk)
+		for _, c := range chunk[:n] {
+			s.add(c)
+		}
+		if err != nil {
+			// Nothing more can complete the prefix.
+			s.out = append(s.out, s.pending...)
+			s.pending = nil
+			s.err = err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	if len(s.out) == 0 && s.err != nil {
+		return n, s.err
+	}
+	return n, nil
+}
+
+func (s *prefixStripper) add(c byte) {
+	if s.atLineStart {
+		s.pending = append(s.pending, c)
+		if loc := s.prefix.re.FindIndex(s.pending); loc != nil {
+			s.out = append(s.out, s.pending[loc[1]:]...)
+			s.pending = s.pending[:0]
+			s.atLineStart = false
+		} else if partialMatch(s.prefix.prog, s.pending) != 0 {
+			s.out = append(s.out, s.pending...)
+			s.pending = s.pending[:0]
+			s.atLineStart = false
+		}
+	} else {
+		s.out = append(s.out, c)
+	}
+	if c == '\n' {
+		s.atLineStart = true
+	}
+}
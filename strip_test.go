@@ -0,0 +1,46 @@
+package gexpect
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSetLinePrefixStrip(t *testing.T) {
+	t.Logf("Testing SetLinePrefixStrip...")
+	const input = "[12:00:01] INFO booting\r\n[12:00:02] INFO ready\r\nlogin: "
+	for _, oneByte := range []bool{false, true} {
+		r := strings.NewReader(input)
+		var raw bytes.Buffer
+		exp := NewExpectIO(r, ioutil.Discard)
+		if oneByte {
+			exp = NewExpectIO(iotest.OneByteReader(r), ioutil.Discard)
+		}
+		exp.SetMirror(&raw)
+		if err := exp.SetLinePrefixStrip(`\[[\d:]+\] \w+ `); err != nil {
+			t.Fatal(err)
+		}
+		matches, err := exp.ExpectRegexFind(`(?m)^ready\r$`)
+		if err != nil {
+			t.Fatalf("expected the prefix to be stripped: %v", err)
+		}
+		if matches[0] != "ready\r" {
+			t.Fatalf("expected 'ready\\r', got %q", matches[0])
+		}
+		line, err := exp.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != "" {
+			t.Fatalf("expected the rest of the line, got %q", line)
+		}
+		if err := exp.Expect("login: "); err != nil {
+			t.Fatalf("expected a line without the prefix to pass through: %v", err)
+		}
+		if raw.String() != input {
+			t.Fatalf("expected the mirror to get the raw output, got %q", raw.String())
+		}
+	}
+}
@@ -3,11 +3,19 @@
 package gexpect
 
 import (
-	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	shell "github.com/kballard/go-shellquote"
 	"github.com/kr/pty"
@@ -15,10 +23,37 @@ import (
 
 type ExpectSubprocess struct {
 	ExpectIO
-	Cmd    *exec.Cmd
-	closer io.Closer
+	Cmd     *exec.Cmd
+	closer  io.Closer
+	winsize *pty.Winsize
+	stderr  *tailBuffer
+	// stderrIO reads the child's stderr for SpawnSeparateStderr.
+	stderrIO *ExpectIO
+
+	// ptmx is the master side of the child's PTY, or the serial port for
+	// SpawnSerial, and nil for SpawnNoPTY.
+	ptmx *os.File
+	// stdout is the read end of the child's stdout pipe for SpawnNoPTY.
+	stdout    *os.File
+	stripEcho bool
+	// logFile is the file opened by LogToFile.
+	logFile *os.File
+
+	waitOnce sync.Once
+	waitDone chan struct{} // closed once the child has exited
+	waitErr  error
 }
 
+// ErrNoPTY is returned by methods that need a PTY when the child was
+// started with pipes.
+var ErrNoPTY = errors.New("gexpect: the child has no PTY")
+
+// ShellPrompt is the prompt set in shells started by SpawnShell.
+const ShellPrompt = "[gexpect]$ "
+
+// maxStderr is how much of a pipe-backed child's stderr is retained.
+const maxStderr = 64 * 1024
+
 func SpawnAtDirectory(command string, directory string) (*ExpectSubprocess, error) {
 	expect, err := _spawn(command)
 	if err != nil {
@@ -41,6 +76,16 @@ func (expect *ExpectSubprocess) Start() error {
 	return err
 }
 
+// SpawnCmd starts a prepared cmd under a PTY. Standard streams that cmd
+// already has set are left alone and only the others are attached to the
+// PTY, e.g. to feed a script to stdin from a file while matching what the
+// child prints.
+func SpawnCmd(cmd *exec.Cmd) (*ExpectSubprocess, error) {
+	expect := &ExpectSubprocess{Cmd: cmd}
+	expect.ExpectIO.buf = new(buffer)
+	return _start(expect)
+}
+
 func Spawn(command string) (*ExpectSubprocess, error) {
 	expect, err := _spawn(command)
 	if err != nil {
@@ -49,34 +94,743 @@ func Spawn(command string) (*ExpectSubprocess, error) {
 	return _start(expect)
 }
 
+// SpawnWithTerminalSize is like Spawn, but the child's PTY takes the size
+// of the terminal attached to stdout so that full-screen programs render
+// at the user's real window size. If stdout is not a terminal the PTY
+// keeps its default size.
+func SpawnWithTerminalSize(command string) (*ExpectSubprocess, error) {
+	expect, err := _spawn(command)
+	if err != nil {
+		return nil, err
+	}
+	if ws, err := pty.GetsizeFull(os.Stdout); err == nil {
+		expect.winsize = ws
+	}
+	return _start(expect)
+}
+
+// SpawnShell starts the user's $SHELL, or /bin/sh if it isn't set, with its
+// prompt set to ShellPrompt. Startup files are skipped for bash and zsh so
+// that they can't override the prompt, and TERM is set to dumb to keep
+// escape sequences out of the output.
+func SpawnShell() (*ExpectSubprocess, error) {
+	path := os.Getenv("SHELL")
+	if path == "" {
+		path = "/bin/sh"
+	}
+	args := []string{path}
+	switch filepath.Base(path) {
+	case "bash":
+		args = append(args, "--norc", "--noprofile")
+	case "zsh":
+		args = append(args, "-f")
+	}
+	expect, err := _spawn(shell.Join(args...))
+	if err != nil {
+		return nil, err
+	}
+	expect.Cmd.Env = append(os.Environ(), "PS1="+ShellPrompt, "PS2=", "PROMPT_COMMAND=", "TERM=dumb")
+	return _start(expect)
+}
+
+// SpawnWithSysProcAttr is like Spawn, but starts the child with a copy of
+// attr, e.g. to set credentials or a parent death signal. The PTY makes the
+// child the leader of a new session with the PTY as its controlling
+// terminal, so Setsid and Setctty are always set, and Setpgid and
+// Foreground are cleared: a session leader already leads its own process
+// group and can't be moved to another one.
+func SpawnWithSysProcAttr(command string, attr *syscall.SysProcAttr) (*ExpectSubprocess, error) {
+	expect, err := _spawn(command)
+	if err != nil {
+		return nil, err
+	}
+	if attr != nil {
+		a := *attr
+		expect.Cmd.SysProcAttr = &a
+	}
+	return _start(expect)
+}
+
+// SpawnWithFallback is like Spawn, but falls back to SpawnNoPTY where no
+// PTY can be allocated, e.g. in some containers. Methods that need a PTY
+// then return ErrNoPTY.
+func SpawnWithFallback(command string) (*ExpectSubprocess, error) {
+	if !ptyAvailable() {
+		return SpawnNoPTY(command)
+	}
+	return Spawn(command)
+}
+
+func ptyAvailable() bool {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return false
+	}
+	ptmx.Close()
+	tty.Close()
+	return true
+}
+
+// SpawnNoPTY starts command with plain pipes instead of a PTY. Its stdout
+// is matched against, while the last 64KB of its stderr are kept aside
+// and can be read with StderrString.
+func SpawnNoPTY(command string) (*ExpectSubprocess, error) {
+	expect, err := _spawn(command)
+	if err != nil {
+		return nil, err
+	}
+	return _startPipes(expect)
+}
+
+// SpawnSeparateStderr is like Spawn, but the child's stderr goes to a pipe
+// of its own instead of the PTY, so that diagnostics can be matched apart
+// from the rest of the output through Stderr. The child blocks once the
+// pipe fills up if nothing reads it, and Wait closes it, so read what is
+// needed from Stderr first.
+func SpawnSeparateStderr(command string) (*ExpectSubprocess, error) {
+	expect, err := _spawn(command)
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := expect.Cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	expect.stderrIO = NewExpectIO(stderr, nil)
+	return _start(expect)
+}
+
+// Stderr returns what reads the child's stderr if it was started by
+// SpawnSeparateStderr, and nil otherwise, when stderr is merged into the
+// PTY or retained for StderrString.
+func (expect *ExpectSubprocess) Stderr() *ExpectIO {
+	return expect.stderrIO
+}
+
+// StdinPipe returns a writer to the stdin of a child started by
+// SpawnNoPTY, to stream large input into it, e.g. with io.Copy, while its
+// output is matched. Writes go the same way as Send, so the two never
+// interleave, and closing it closes stdin. Under a PTY the input is echoed
+// and subject to the terminal's flow control, so there is no such pipe and
+// nil is returned; use SendReader there.
+func (expect *ExpectSubprocess) StdinPipe() io.WriteCloser {
+	if expect.ptmx != nil || expect.closer == nil {
+		return nil
+	}
+	return stdinPipe{expect}
+}
+
+type stdinPipe struct {
+	expect *ExpectSubprocess
+}
+
+func (p stdinPipe) Write(b []byte) (int, error) {
+	return p.expect.buf.Write(b)
+}
+
+func (p stdinPipe) Close() error {
+	return p.expect.closer.Close()
+}
+
+// StderrString returns the retained stderr of a child started by
+// SpawnNoPTY. Under a PTY stderr is merged into the matched output, so
+// the result is always empty.
+func (expect *ExpectSubprocess) StderrString() string {
+	if expect.stderr == nil {
+		return ""
+	}
+	return expect.stderr.String()
+}
+
+// Close kills the child. If it leads its own process group, as PTY
+// children always do, the whole group is killed so that no descendants
+// are left behind.
 func (expect *ExpectSubprocess) Close() error {
-	if err := expect.Cmd.Process.Kill(); err != nil {
+	defer expect.closeLog()
+	if err := expect.kill(); err != nil {
 		return err
 	}
 	if err := expect.closer.Close(); err != nil {
 		return err
 	}
+	if expect.stdout != nil {
+		return expect.stdout.Close()
+	}
+	return nil
+}
+
+// LogToFile writes everything received from the child to the file at
+// path from now on, like SetMirror but alongside it, so that the session
+// can be read later or replayed with NewExpectIOReplay. Under a PTY that
+// includes the echo of what was sent. The file is created if needed, and
+// appended to if appendToFile is set or truncated otherwise. Close and
+// CloseAndWait close it, as does logging to another file.
+func (expect *ExpectSubprocess) LogToFile(path string, appendToFile bool) error {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendToFile {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return err
+	}
+	expect.closeLog()
+	expect.logFile = f
+	expect.buf.fileLog = f
+	return nil
+}
+
+// closeLog stops logging to the file of LogToFile, if any, and closes it.
+func (expect *ExpectSubprocess) closeLog() {
+	if expect.logFile == nil {
+		return
+	}
+	expect.buf.fileLog = nil
+	expect.logFile.Close()
+	expect.logFile = nil
+}
+
+func (expect *ExpectSubprocess) kill() error {
+	if expect.Cmd == nil {
+		return nil
+	}
+	pid := expect.Cmd.Process.Pid
+	if pgid, err := syscall.Getpgid(pid); err == nil && pgid == pid {
+		return syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+	return expect.Cmd.Process.Kill()
+}
+
+// CloseAndWait signals end of input to the child, reads the rest of its
+// output and waits for it to exit. Under a PTY the terminal's EOF character
+// is sent, which only takes effect at the start of a line; for SpawnNoPTY
+// children stdin is closed.
+func (expect *ExpectSubprocess) CloseAndWait() (string, error) {
+	if expect.Cmd == nil {
+		// A serial port has no child to wait for.
+		return "", expect.closer.Close()
+	}
+	if expect.ptmx != nil {
+		eof := byte(4)
+		if termios, err := getTermios(expect.ptmx); err == nil {
+			eof = termios.Cc[syscall.VEOF]
+		}
+		if err := expect.Send(string(eof)); err != nil {
+			return "", err
+		}
+	} else if err := expect.closer.Close(); err != nil {
+		return "", err
+	}
+	var output bytes.Buffer
+	if _, err := io.Copy(&output, expect.buf); err != nil {
+		return output.String(), err
+	}
+	err := expect.Wait()
+	if expect.ptmx != nil {
+		expect.closer.Close()
+	}
+	if expect.stdout != nil {
+		expect.stdout.Close()
+	}
+	expect.closeLog()
+	return output.String(), err
+}
+
+// SendInterrupt interrupts the child the way Ctrl-C would. If the PTY's
+// line discipline generates signals, the terminal's interrupt character is
+// written; in raw mode it wouldn't be acted upon, so SIGINT is sent to the
+// child's process group directly. SpawnNoPTY children are signalled alone, and
+// over a serial port the interrupt character is always sent.
+func (expect *ExpectSubprocess) SendInterrupt() error {
+	if expect.ptmx == nil {
+		return expect.Cmd.Process.Signal(os.Interrupt)
+	}
+	termios, err := getTermios(expect.ptmx)
+	if err != nil {
+		return err
+	}
+	if termios.Lflag&syscall.ISIG != 0 || expect.Cmd == nil {
+		return expect.Send(string(termios.Cc[syscall.VINTR]))
+	}
+	pgid, err := syscall.Getpgid(expect.Cmd.Process.Pid)
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(-pgid, syscall.SIGINT)
+}
+
+// signals maps the names SendSignalByName accepts to their signals.
+var signals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"TERM":  syscall.SIGTERM,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"ALRM":  syscall.SIGALRM,
+	"PIPE":  syscall.SIGPIPE,
+	"CHLD":  syscall.SIGCHLD,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"TTIN":  syscall.SIGTTIN,
+	"TTOU":  syscall.SIGTTOU,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// SendSignalByName sends the signal called name, such as "INT", "TERM" or
+// "USR1", with or without the "SIG" prefix and in any case, e.g. for
+// scripts that take signals from their configuration. If the child leads
+// its own process group, as PTY children always do, the whole group gets
+// it; SpawnNoPTY children are signalled alone.
+func (expect *ExpectSubprocess) SendSignalByName(name string) error {
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return fmt.Errorf("gexpect: unknown signal %q", name)
+	}
+	if expect.Cmd == nil {
+		return errors.New("gexpect: there is no child to signal")
+	}
+	pid := expect.Cmd.Process.Pid
+	if pgid, err := syscall.Getpgid(pid); err == nil && pgid == pid {
+		return syscall.Kill(-pgid, sig)
+	}
+	return expect.Cmd.Process.Signal(sig)
+}
+
+// SendSync is like Send, but under a PTY it returns only once the terminal
+// reports the input transmitted to the child, which paces slow consumers
+// more precisely than fixed delays. SpawnNoPTY children have no such
+// report, so it returns as soon as the pipe took the input.
+func (expect *ExpectSubprocess) SendSync(command string) error {
+	if err := expect.Send(command); err != nil {
+		return err
+	}
+	if expect.ptmx == nil {
+		return nil
+	}
+	return tcdrain(expect.ptmx)
+}
+
+// SendBreak holds the line in the break state for d, e.g. to stop a
+// bootloader on a serial console. Pipes have no such thing, so it returns
+// ErrNoPTY for SpawnNoPTY children.
+func (expect *ExpectSubprocess) SendBreak(d time.Duration) error {
+	if expect.ptmx == nil {
+		return ErrNoPTY
+	}
+	if err := ioctlInt(expect.ptmx, syscall.TIOCSBRK, 0); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return ioctlInt(expect.ptmx, syscall.TIOCCBRK, 0)
+}
+
+// SetWindowSize resizes the child's PTY, which sends it SIGWINCH.
+func (expect *ExpectSubprocess) SetWindowSize(rows, cols uint16) error {
+	if expect.ptmx == nil {
+		return ErrNoPTY
+	}
+	return setWinsize(expect.ptmx, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+// Resize is like SetWindowSize, the way a user resizing their terminal
+// would, but also sends SIGWINCH to the child's process group itself: the
+// terminal only signals its foreground process group, and only if the size
+// actually changed. Over a serial port there is no child to signal.
+func (expect *ExpectSubprocess) Resize(rows, cols uint16) error {
+	if expect.ptmx == nil {
+		return ErrNoPTY
+	}
+	if err := setWinsize(expect.ptmx, &pty.Winsize{Rows: rows, Cols: cols}); err != nil {
+		return err
+	}
+	if expect.Cmd == nil {
+		return nil
+	}
+	pgid, err := syscall.Getpgid(expect.Cmd.Process.Pid)
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(-pgid, syscall.SIGWINCH)
+}
+
+// SetEcho turns the PTY's echo of input on or off.
+func (expect *ExpectSubprocess) SetEcho(on bool) error {
+	if expect.ptmx == nil {
+		return ErrNoPTY
+	}
+	termios, err := getTermios(expect.ptmx)
+	if err != nil {
+		return err
+	}
+	if on {
+		termios.Lflag |= syscall.ECHO
+	} else {
+		termios.Lflag &^= syscall.ECHO
+	}
+	return setTermios(expect.ptmx, termios)
+}
+
+// EnableTerminalEmulation keeps a virtual screen of rows by cols that is
+// updated with everything the child writes, following cursor movement and
+// erasing, so that ExpectScreen can match what a full-screen program
+// displays. The PTY is resized to match, so rows and cols must be between
+// 1 and 65535.
+func (expect *ExpectSubprocess) EnableTerminalEmulation(rows, cols int) error {
+	if rows < 1 || cols < 1 || rows > math.MaxUint16 || cols > math.MaxUint16 {
+		return fmt.Errorf("gexpect: invalid screen size %dx%d", rows, cols)
+	}
+	if expect.ptmx != nil {
+		if err := setWinsize(expect.ptmx, &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)}); err != nil {
+			return err
+		}
+	}
+	expect.enableScreen(rows, cols)
 	return nil
 }
 
 func (expect *ExpectSubprocess) Interact() {
-	defer expect.Cmd.Wait()
-	io.Copy(os.Stdout, &expect.ExpectIO.buf.b)
-	go io.Copy(os.Stdout, expect.ExpectIO.buf.rw)
-	go io.Copy(expect.ExpectIO.buf.rw, os.Stdin)
+	defer expect.Wait()
+	// Reading through buf serves what was put back and a read still under
+	// way before anything new.
+	go io.Copy(os.Stdout, expect.ExpectIO.buf)
+	go io.Copy(expect.ExpectIO.buf, os.Stdin)
+}
+
+// InteractAfter waits for regex, e.g. the shell prompt after an automated
+// login, then hands the session over to the user with Interact. The line
+// the match ends on is shown first, so that the user sees the prompt.
+func (expect *ExpectSubprocess) InteractAfter(regex string) error {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return err
+	}
+	pairs, out, err := expect.expectRegexFindIndex(re)
+	if err != nil {
+		return err
+	}
+	lineStart := strings.LastIndex(out[:pairs[0]], "\n") + 1
+	if _, err := io.WriteString(os.Stdout, out[lineStart:]); err != nil {
+		return err
+	}
+	expect.Interact()
+	return nil
+}
+
+// ConsumeEcho reads and discards the terminal's echo of sent, which must be
+// the next thing in the output. The line discipline echoes every carriage
+// return and newline as "\r\n", so that translation is applied to sent
+// first. If the output doesn't start with the echo, whatever was read is
+// put back and an error is returned.
+func (expect *ExpectSubprocess) ConsumeEcho(sent string) error {
+	echo := echoOf(sent)
+	got := make([]byte, 0, len(echo))
+	chunk := make([]byte, len(echo))
+	for len(got) < len(echo) {
+		n, err := expect.buf.Read(chunk[:len(echo)-len(got)])
+		got = append(got, chunk[:n]...)
+		if !strings.HasPrefix(echo, string(got)) {
+			expect.buf.PutBack(got)
+			return fmt.Errorf("ConsumeEcho expected echo %q, got %q", echo, got)
+		}
+		if err != nil && len(got) < len(echo) {
+			expect.buf.PutBack(got)
+			return err
+		}
+	}
+	return nil
+}
+
+// settleIdle is how long output must pause for SettleEcho to consider the
+// echo complete.
+const settleIdle = 100 * time.Millisecond
+
+// SettleEcho reads and discards output until none has arrived for a short
+// while, or until timeout has passed, so that echo still trickling in from
+// a slow device can't race with the next Expect. Unlike a non-blocking
+// drain it waits for output that is on its way. Running out of time is not
+// an error.
+func (expect *ExpectSubprocess) SettleEcho(timeout time.Duration) error {
+	f := expect.ptmx
+	if f == nil {
+		f = expect.stdout
+	}
+	if f == nil {
+		return errors.New("gexpect: the child's output doesn't support read deadlines")
+	}
+	defer f.SetReadDeadline(time.Time{})
+	end := time.Now().Add(timeout)
+	chunk := make([]byte, 4096)
+	for {
+		deadline := time.Now().Add(settleIdle)
+		if deadline.After(end) {
+			deadline = end
+		}
+		if err := f.SetReadDeadline(deadline); err != nil {
+			return err
+		}
+		if _, err := expect.buf.Read(chunk); err != nil {
+			if os.IsTimeout(err) {
+				// A decoder or prefix stripper keeps failing once it
+				// has seen an error, so they start over. What they
+				// held back is discarded with the rest.
+				expect.buf.resetReader()
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// SetStripEcho makes SendLine consume the terminal's echo of each line it
+// sends, so that later matches only see the child's response. Nothing is
+// stripped while echo is turned off on the PTY, or for SpawnNoPTY children.
+func (expect *ExpectSubprocess) SetStripEcho(strip bool) {
+	expect.stripEcho = strip
+}
+
+// SendLine sends command followed by "\r\n", consuming its echo if
+// SetStripEcho is on.
+func (expect *ExpectSubprocess) SendLine(command string) error {
+	echoLeft := expect.echoLeft
+	if err := expect.ExpectIO.SendLine(command); err != nil {
+		return err
+	}
+	if expect.stripEcho && expect.echoing() {
+		expect.echoLeft = echoLeft
+		return expect.ConsumeEcho(command + "\r\n")
+	}
+	if expect.Cmd != nil && !expect.echoing() {
+		// There is no echo to ignore.
+		expect.echoLeft = echoLeft
+	}
+	return nil
+}
+
+// SendScript feeds lines to the child one at a time with SendLine, waiting
+// for prompt, a literal string, to appear after each one before sending
+// the next, e.g. to drive a REPL. It stops at the first failure with a
+// *ScriptError telling which line it was.
+func (expect *ExpectSubprocess) SendScript(lines []string, prompt string) error {
+	for i, line := range lines {
+		err := expect.SendLine(line)
+		if err == nil {
+			err = expect.Expect(prompt)
+		}
+		if err != nil {
+			return &ScriptError{Line: i + 1, Text: line, Err: err}
+		}
+	}
+	return nil
+}
+
+// ScriptError reports the line of a script that SendScript failed on.
+type ScriptError struct {
+	Line int // counting from 1
+	Text string
+	Err  error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("gexpect: script failed at line %d %q: %v", e.Line, e.Text, e.Err)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// echoing reports whether the PTY's line discipline echoes input.
+func (expect *ExpectSubprocess) echoing() bool {
+	if expect.ptmx == nil {
+		return false
+	}
+	termios, err := getTermios(expect.ptmx)
+	if err != nil {
+		return false
+	}
+	return termios.Lflag&syscall.ECHO != 0
+}
+
+// SendConfirm is like ExpectIO.SendConfirm, but if the PTY echoes input it
+// expects the echo as the line discipline renders it, with each carriage
+// return or newline turned into "\r\n".
+func (expect *ExpectSubprocess) SendConfirm(command string, timeout time.Duration) error {
+	if err := expect.Send(command); err != nil {
+		return err
+	}
+	echo := command
+	if expect.echoing() {
+		echo = echoOf(command)
+	}
+	return expect.ExpectTimeout(echo, timeout)
 }
 
 func (expect *ExpectSubprocess) Wait() error {
-	return expect.Cmd.Wait()
+	<-expect.Done()
+	return expect.waitErr
+}
+
+// Done returns a channel that is closed once the child has exited, to
+// select on it along with other events, much like the Done of a
+// context.Context. Like Wait it reaps the child, and closes the pipe of
+// SpawnSeparateStderr. Over a serial port there is no child, so the
+// channel is closed at once.
+func (expect *ExpectSubprocess) Done() <-chan struct{} {
+	expect.waitOnce.Do(func() {
+		expect.waitDone = make(chan struct{})
+		go func() {
+			if expect.Cmd != nil {
+				expect.waitErr = expect.Cmd.Wait()
+			}
+			close(expect.waitDone)
+		}()
+	})
+	return expect.waitDone
+}
+
+// ExpectRegexOrExit waits for regex like ExpectRegexFind, but also stops
+// once the child exits, and reports which happened. Output the child wrote
+// before exiting is still searched, for a short while at most, so that a
+// match isn't mistaken for an exit. exited is then true only if there was
+// no match; Err tells why the child exited. Over a serial port there is no
+// child, so it only waits for regex.
+func (expect *ExpectSubprocess) ExpectRegexOrExit(regex string) (groups []string, exited bool, err error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, false, err
+	}
+	var done <-chan struct{}
+	if expect.Cmd != nil {
+		done = expect.Done()
+	}
+	pairs, out, err := expect.regexFind(re, expect.maxBufferSize, false, done)
+	if err != errCanceled {
+		return submatches(out, pairs), false, err
+	}
+	grace, stop := closeAfter(settleIdle)
+	defer stop()
+	pairs, out, err = expect.regexFind(re, expect.maxBufferSize, false, grace)
+	if err != nil {
+		return nil, true, nil
+	}
+	return submatches(out, pairs), false, nil
+}
+
+// Err returns nil until Done is closed, and then what Wait returns, e.g.
+// an *exec.ExitError for a child that failed.
+func (expect *ExpectSubprocess) Err() error {
+	select {
+	case <-expect.Done():
+		return expect.waitErr
+	default:
+		return nil
+	}
+}
+
+// ExpectExit waits for the child to exit and returns nil only if its exit
+// status is code. Otherwise the error tells how it did end, with another
+// status or killed by a signal. It can also be called after Wait. Over a
+// serial port there is no child, so it fails.
+func (expect *ExpectSubprocess) ExpectExit(code int) error {
+	if expect.Cmd == nil {
+		return errors.New("gexpect: there is no child to exit")
+	}
+	err := expect.Wait()
+	state := expect.Cmd.ProcessState
+	if state == nil {
+		return err
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return fmt.Errorf("gexpect: expected exit status %d, but the child was killed by %v", code, status.Signal())
+	}
+	if state.ExitCode() != code {
+		return fmt.Errorf("gexpect: expected exit status %d, got %d", code, state.ExitCode())
+	}
+	return nil
 }
 
 func _start(expect *ExpectSubprocess) (*ExpectSubprocess, error) {
-	f, err := pty.Start(expect.Cmd)
+	if attr := expect.Cmd.SysProcAttr; attr != nil {
+		// pty.Start sets Setsid, after which setpgid would fail.
+		attr.Setpgid = false
+		attr.Foreground = false
+	}
+	// The PTY becomes the controlling terminal through the first standard
+	// stream attached to it, which is stdin unless the caller set that.
+	if cmd := expect.Cmd; cmd.Stdin != nil {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		switch {
+		case cmd.Stdout == nil:
+			cmd.SysProcAttr.Ctty = 1
+		case cmd.Stderr == nil:
+			cmd.SysProcAttr.Ctty = 2
+		default:
+			return nil, errors.New("gexpect: no standard stream left to attach to the PTY")
+		}
+	}
+	var f *os.File
+	var err error
+	if expect.winsize != nil {
+		f, err = pty.StartWithSize(expect.Cmd, expect.winsize)
+	} else {
+		f, err = pty.Start(expect.Cmd)
+	}
 	if err != nil {
 		return nil, err
 	}
-	expect.ExpectIO.buf.rw = bufio.NewReadWriter(bufio.NewReader(f), bufio.NewWriter(f))
+	// kr/pty leaves the master in blocking mode.
+	if f, err = pollable(f); err != nil {
+		return nil, err
+	}
+	expect.ExpectIO.buf.attach(ptyReader{f}, f)
 	expect.closer = f
+	expect.ptmx = f
+
+	return expect, nil
+}
+
+// ptyReader reads the master side of a PTY. Once the child has exited
+// Linux fails the read with EIO instead of returning EOF, which is turned
+// into io.EOF here so callers see the same end of output everywhere.
+type ptyReader struct {
+	f *os.File
+}
+
+func (r ptyReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EIO {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func _startPipes(expect *ExpectSubprocess) (*ExpectSubprocess, error) {
+	stdin, err := expect.Cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	// Unlike with StdoutPipe, waiting for the child doesn't close the
+	// read end, so that Done can't cut off output not read yet.
+	stdout, childStdout, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	expect.Cmd.Stdout = childStdout
+	expect.stderr = &tailBuffer{max: maxStderr}
+	expect.Cmd.Stderr = expect.stderr
+	err = expect.Cmd.Start()
+	childStdout.Close()
+	if err != nil {
+		stdout.Close()
+		return nil, err
+	}
+	expect.ExpectIO.buf.attach(stdout, stdin)
+	expect.closer = stdin
+	expect.stdout = stdout
 
 	return expect, nil
 }
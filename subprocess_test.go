@@ -3,7 +3,21 @@
 package gexpect
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/kr/pty"
+	"golang.org/x/text/encoding/charmap"
 )
 
 func TestSpawn(t *testing.T) {
@@ -29,3 +43,819 @@ func TestCommandStart(t *testing.T) {
 	child.Start()
 	child.Expect("Hello World")
 }
+
+func TestSpawnWithTerminalSize(t *testing.T) {
+	t.Logf("Testing SpawnWithTerminalSize... ")
+	// stdout is usually not a terminal under go test, in which case the
+	// default size must be kept rather than failing the spawn.
+	child, err := SpawnWithTerminalSize("echo 'Hello World'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Expect("Hello World"); err != nil {
+		t.Fatal(err)
+	}
+
+	// With a terminal as stdout the child gets its size.
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	if err := pty.Setsize(ptmx, &pty.Winsize{Rows: 31, Cols: 97}); err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = tty
+	child, err = SpawnWithTerminalSize("stty size")
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Expect("31 97"); err != nil {
+		t.Fatalf("expected the child's terminal to be 31x97: %v", err)
+	}
+}
+
+func TestConsumeEcho(t *testing.T) {
+	t.Logf("Testing ConsumeEcho... ")
+	child, err := Spawn("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if err := child.Send("hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.ConsumeEcho("hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := child.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\r" {
+		t.Fatalf("expected cat's output after the echo, got %q", line)
+	}
+}
+
+func TestSpawnNoPTYStderr(t *testing.T) {
+	t.Logf("Testing SpawnNoPTY stderr retention... ")
+	child, err := SpawnNoPTY("sh -c 'echo out; echo err >&2'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Expect("out"); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if stderr := child.StderrString(); stderr != "err\n" {
+		t.Fatalf("expected stderr 'err\\n', got %q", stderr)
+	}
+}
+
+func TestStdinPipe(t *testing.T) {
+	t.Logf("Testing StdinPipe... ")
+	child, err := SpawnNoPTY("wc -c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := child.StdinPipe()
+	go func() {
+		io.Copy(stdin, bytes.NewReader(make([]byte, 1<<20)))
+		stdin.Close()
+	}()
+	if err := child.Expect("1048576"); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	child, err = Spawn("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if child.StdinPipe() != nil {
+		t.Fatal("expected no stdin pipe under a PTY")
+	}
+}
+
+func TestSpawnSeparateStderr(t *testing.T) {
+	t.Logf("Testing SpawnSeparateStderr... ")
+	child, err := SpawnSeparateStderr("sh -c 'echo warning: disk >&2; echo out; read x'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if groups, err := child.Stderr().ExpectRegexFind(`warning: (\w+)`); err != nil || groups[1] != "disk" {
+		t.Fatalf("Expected the warning on stderr, got %q, %v", groups, err)
+	}
+	_, output, err := child.ExpectRegexFindWithOutput(`out`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output, "warning") {
+		t.Fatalf("stderr leaked into the PTY: %q", output)
+	}
+	merged, err := Spawn("true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer merged.Wait()
+	if merged.Stderr() != nil {
+		t.Fatal("Expected no separate stderr under Spawn")
+	}
+}
+
+func TestChildExitIsEOF(t *testing.T) {
+	t.Logf("Testing reading past the child's exit... ")
+	child, err := Spawn("echo 'Hello World'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Expect("Hello World"); err != nil {
+		t.Fatal(err)
+	}
+	child.Wait()
+	for {
+		_, err = child.ReadLine()
+		if err != nil {
+			break
+		}
+	}
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF once the child exited, got %v", err)
+	}
+}
+
+func TestSpawnShell(t *testing.T) {
+	t.Logf("Testing SpawnShell... ")
+	child, err := SpawnShell()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if err := child.ExpectTimeout(ShellPrompt, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	child.SendLine("echo $((6 * 7))")
+	if err := child.ExpectTimeout("42\r\n"+ShellPrompt, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStripEcho(t *testing.T) {
+	t.Logf("Testing SetStripEcho... ")
+	child, err := Spawn("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	child.SetStripEcho(true)
+	if err := child.SendLine("hello"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := child.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\r" {
+		t.Fatalf("expected cat's output without the echo, got %q", line)
+	}
+
+	child, err = SpawnNoPTY("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	child.SetStripEcho(true)
+	if err := child.SendLine("hello"); err != nil {
+		t.Fatal(err)
+	}
+	line, err = child.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\r" {
+		t.Fatalf("expected nothing to be stripped without a PTY, got %q", line)
+	}
+}
+
+func TestIgnoreEcho(t *testing.T) {
+	t.Logf("Testing SetIgnoreEcho... ")
+	child, err := Spawn("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	child.SetIgnoreEcho(true)
+	if err := child.SendLine("hello"); err != nil {
+		t.Fatal(err)
+	}
+	_, out, err := child.ExpectRegexFindWithOutput(`hello`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "hello\r\n\r\nhello" {
+		t.Fatalf("expected the match in cat's output after the echo, got %q", out)
+	}
+	if err := child.SendLine("world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Expect("world"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := child.ExpectTimeoutRegexFind(`world`, 300*time.Millisecond); err == nil {
+		t.Fatal("expected Expect to have matched cat's output, not the echo")
+	}
+
+	child, err = SpawnNoPTY("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	child.SetIgnoreEcho(true)
+	if err := child.SendLine("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, out, err := child.ExpectRegexFindWithOutput(`hello`); err != nil || out != "hello" {
+		t.Fatalf("expected nothing to be ignored without echo, got %q %v", out, err)
+	}
+}
+
+func TestSendScript(t *testing.T) {
+	t.Logf("Testing SendScript... ")
+	child, err := SpawnNoPTY(`sh -c 'while printf "> " && read line; do echo "got $line"; done'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if err := child.Expect("> "); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.SendScript([]string{"one", "two"}, "> "); err != nil {
+		t.Fatal(err)
+	}
+	if out := child.SinceLastMatch(); out != "got two\r\n> " {
+		t.Fatalf("expected to be at the prompt after the last line, got %q", out)
+	}
+
+	// The REPL goes away after the first line.
+	child, err = SpawnNoPTY(`sh -c 'printf "> "; read line; echo bye'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if err := child.Expect("> "); err != nil {
+		t.Fatal(err)
+	}
+	err = child.SendScript([]string{"one", "two", "three"}, "> ")
+	scriptErr, ok := err.(*ScriptError)
+	if !ok || scriptErr.Line != 1 || scriptErr.Text != "one" || !errors.Is(err, io.EOF) {
+		t.Fatalf("expected a *ScriptError at the first line, got %v", err)
+	}
+}
+
+func TestCloseAndWait(t *testing.T) {
+	t.Logf("Testing CloseAndWait... ")
+	child, err := SpawnNoPTY("sort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	child.Send("b\na\n")
+	output, err := child.CloseAndWait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "a\nb\n" {
+		t.Fatalf("expected sorted output, got %q", output)
+	}
+
+	child, err = Spawn("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	child.Send("hello\n")
+	output, err = child.CloseAndWait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "hello\r\nhello\r\n" {
+		t.Fatalf("expected the echo and cat's output, got %q", output)
+	}
+}
+
+func TestExpectExit(t *testing.T) {
+	t.Logf("Testing ExpectExit... ")
+	child, err := Spawn("sh -c 'exit 3'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.ExpectExit(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.ExpectExit(0); err == nil || !strings.Contains(err.Error(), "got 3") {
+		t.Fatalf("expected the actual status after Wait, got %v", err)
+	}
+
+	child, err = SpawnNoPTY("sh -c 'kill -9 $$'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.ExpectExit(0); err == nil || !strings.Contains(err.Error(), "killed") {
+		t.Fatalf("expected the signal to be reported, got %v", err)
+	}
+}
+
+func TestDone(t *testing.T) {
+	t.Logf("Testing Done and Err... ")
+	for _, spawn := range []func(string) (*ExpectSubprocess, error){Spawn, SpawnNoPTY} {
+		child, err := spawn("sh -c 'echo bye; exit 2'")
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-child.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected Done to be closed once the child exited")
+		}
+		if _, ok := child.Err().(*exec.ExitError); !ok {
+			t.Fatalf("expected an *exec.ExitError, got %v", child.Err())
+		}
+		// The output is still there after the child was reaped.
+		if err := child.Expect("bye"); err != nil {
+			t.Fatal(err)
+		}
+		if err := child.Wait(); err != child.Err() {
+			t.Fatalf("expected Wait to return the same error, got %v", err)
+		}
+	}
+
+	child, err := Spawn("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if child.Err() != nil {
+		t.Fatalf("expected no error while the child runs, got %v", child.Err())
+	}
+	child.Close()
+	<-child.Done()
+}
+
+func TestExpectRegexOrExit(t *testing.T) {
+	t.Logf("Testing ExpectRegexOrExit... ")
+	// A background process keeps the output open after the child exits.
+	child, err := SpawnNoPTY(`sh -c 'sleep 1 2>/dev/null & echo starting; exit 3'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	groups, exited, err := child.ExpectRegexOrExit(`listening on (\d+)`)
+	if err != nil || !exited || groups != nil {
+		t.Fatalf("expected the exit to be reported, got %q %v %v", groups, exited, err)
+	}
+	if _, ok := child.Err().(*exec.ExitError); !ok {
+		t.Fatalf("expected the exit status, got %v", child.Err())
+	}
+
+	// A match written right before exiting still counts.
+	child, err = SpawnNoPTY(`sh -c 'echo listening on 8080; exit 0'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-child.Done()
+	groups, exited, err = child.ExpectRegexOrExit(`listening on (\d+)`)
+	if err != nil || exited || groups[1] != "8080" {
+		t.Fatalf("expected the match, got %q %v %v", groups, exited, err)
+	}
+}
+
+func TestLogToFile(t *testing.T) {
+	t.Logf("Testing LogToFile... ")
+	dir, err := ioutil.TempDir("", "gexpect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.log")
+	for i, appendToFile := range []bool{false, true, false} {
+		child, err := SpawnNoPTY("echo session " + strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := child.LogToFile(path, appendToFile); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := child.CloseAndWait(); err != nil {
+			t.Fatal(err)
+		}
+		log, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[int]string{0: "session 0\n", 1: "session 0\nsession 1\n", 2: "session 2\n"}[i]
+		if string(log) != want {
+			t.Fatalf("expected the log %q, got %q", want, log)
+		}
+	}
+
+	// A mirror set before or after keeps working alongside the file.
+	child, err := SpawnNoPTY("echo mirrored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before, after bytes.Buffer
+	child.SetMirror(&before)
+	if err := child.LogToFile(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if child.buf.mirror != &before {
+		t.Fatal("expected LogToFile to leave the mirror alone")
+	}
+	child.SetMirror(&after)
+	if _, err := child.CloseAndWait(); err != nil {
+		t.Fatal(err)
+	}
+	if log, _ := ioutil.ReadFile(path); string(log) != "mirrored\n" || after.String() != "mirrored\n" {
+		t.Fatalf("expected both the log and the mirror to get the output, got %q and %q", log, after.String())
+	}
+	if child.buf.mirror != &after {
+		t.Fatal("expected closing the log to leave the mirror alone")
+	}
+
+	if err := (&ExpectSubprocess{}).LogToFile(filepath.Join(dir, "missing", "x.log"), false); err == nil {
+		t.Fatal("expected an error for a file that can't be created")
+	}
+}
+
+func TestSendSignalByName(t *testing.T) {
+	t.Logf("Testing SendSignalByName... ")
+	child, err := Spawn(`sh -c 'trap "echo got usr1" USR1; echo ready; while :; do sleep 0.05; done'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if err := child.ExpectTimeout("ready", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.SendSignalByName("usr1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.ExpectTimeout("got usr1", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.SendSignalByName("SIGTERM"); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.ExpectExit(0); err == nil || !strings.Contains(err.Error(), "terminated") {
+		t.Fatalf("expected the child to be terminated, got %v", err)
+	}
+	if err := child.SendSignalByName("BOGUS"); err == nil {
+		t.Fatal("expected an unknown signal to be rejected")
+	}
+}
+
+func TestSendInterrupt(t *testing.T) {
+	t.Logf("Testing SendInterrupt... ")
+	for _, command := range []string{
+		"sh -c 'echo ready; exec sleep 10'",
+		"sh -c 'stty raw; echo ready; exec sleep 10'",
+	} {
+		child, err := Spawn(command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := child.ExpectTimeout("ready", 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if err := child.SendInterrupt(); err != nil {
+			t.Fatal(err)
+		}
+		err = child.Wait()
+		if err == nil || err.Error() != "signal: interrupt" {
+			t.Fatalf("%s: expected the child to be interrupted, got %v", command, err)
+		}
+		child.Close()
+	}
+}
+
+func TestEnableTerminalEmulation(t *testing.T) {
+	t.Logf("Testing EnableTerminalEmulation... ")
+	child, err := Command(`printf 'loading...\r\033[Kdone\n'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range [][2]int{{0, 80}, {24, 0}, {-1, 80}, {24, 70000}} {
+		if err := child.EnableTerminalEmulation(size[0], size[1]); err == nil {
+			t.Fatalf("expected the size %dx%d to be rejected", size[0], size[1])
+		}
+	}
+	if err := child.EnableTerminalEmulation(30, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := child.ExpectScreen(`(?m)^done$`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpawnWithSysProcAttr(t *testing.T) {
+	t.Logf("Testing SpawnWithSysProcAttr... ")
+	child, err := SpawnWithSysProcAttr(`sh -c "trap '' HUP; sleep 100 & echo pid \$!; wait"`, &syscall.SysProcAttr{Setpgid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pgid, err := syscall.Getpgid(child.Cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pgid != child.Cmd.Process.Pid {
+		t.Fatalf("expected the child to lead its process group, got pgid %d", pgid)
+	}
+	matches, err := child.ExpectRegexFind(`pid (\d+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sleeper, _ := strconv.Atoi(matches[1])
+	if err := child.Close(); err != nil {
+		t.Fatal(err)
+	}
+	child.Wait()
+	for i := 0; ; i++ {
+		out, _ := exec.Command("ps", "-o", "stat=", "-p", matches[1]).Output()
+		if syscall.Kill(sleeper, 0) != nil || strings.HasPrefix(string(out), "Z") {
+			break
+		}
+		if i == 50 {
+			t.Fatal("expected Close to kill the child's descendants")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSettleEcho(t *testing.T) {
+	t.Logf("Testing SettleEcho... ")
+	child, err := Spawn(`sh -c "printf a; sleep 0.05; printf b; sleep 0.5; printf done"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	start := time.Now()
+	if err := child.SettleEcho(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Fatalf("expected SettleEcho to stop once the output went idle, took %v", elapsed)
+	}
+	if state := child.String(); strings.Contains(state, "output ended: true") {
+		t.Fatalf("expected the output not to have ended after SettleEcho, got %s", state)
+	}
+	out, err := child.ExpectBytesCount(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "done" {
+		t.Fatalf("expected the settled output to be discarded, got %q", out)
+	}
+
+	child, err = Spawn(`sh -c "while :; do printf x; sleep 0.01; done"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	start = time.Now()
+	if err := child.SettleEcho(200 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected SettleEcho to give up after its timeout, took %v", elapsed)
+	}
+}
+
+func TestSettleEchoKeepsReading(t *testing.T) {
+	t.Logf("Testing reads after SettleEcho through a decoder and a prefix stripper... ")
+	setups := map[string]func(*ExpectSubprocess){
+		"decoder": func(child *ExpectSubprocess) { child.SetDecoder(charmap.ISO8859_1.NewDecoder()) },
+		"strip":   func(child *ExpectSubprocess) { child.SetLinePrefixStrip(`\[\d+\] `) },
+	}
+	for name, setup := range setups {
+		child, err := Spawn(`sh -c "printf echo; sleep 0.3; echo '[1] done'"`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setup(child)
+		if err := child.SettleEcho(5 * time.Second); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := child.Expect("done"); err != nil {
+			t.Errorf("%s: expected reads to go on after SettleEcho, got %v", name, err)
+		}
+		child.Close()
+	}
+}
+
+func TestSendSync(t *testing.T) {
+	t.Logf("Testing SendSync... ")
+	child, err := Spawn("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if err := child.SendSync("hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.ExpectTimeout("hello", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpawnCmd(t *testing.T) {
+	t.Logf("Testing SpawnCmd... ")
+	script, err := ioutil.TempFile("", "gexpect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(script.Name())
+	script.WriteString("echo out; echo err >&2\n")
+	script.Seek(0, io.SeekStart)
+	defer script.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("sh")
+	cmd.Stdin = script
+	cmd.Stderr = &stderr
+	child, err := SpawnCmd(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	output, err := child.CloseAndWait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "out\r\n" {
+		t.Fatalf("expected only stdout on the PTY, got %q", output)
+	}
+	if stderr.String() != "err\n" {
+		t.Fatalf("expected stderr to go to the buffer, got %q", stderr.String())
+	}
+}
+
+func TestInteractAfterMissingPattern(t *testing.T) {
+	t.Logf("Testing InteractAfter when the pattern never appears... ")
+	child, err := Spawn(`echo "Login incorrect"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if err := child.InteractAfter(`\$ $`); err == nil {
+		t.Fatal("expected an error when the prompt never appears")
+	}
+}
+
+func TestInteractAfterTimeout(t *testing.T) {
+	t.Logf("Testing Interact after a search timed out... ")
+	child, err := Spawn(`sh -c "printf banner; sleep 0.3; printf tail"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	// Leaves "banner" put back and a read waiting for "tail".
+	if err := child.ExpectTimeout("zzz", 100*time.Millisecond); err == nil {
+		t.Fatal("expected a timeout")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	stdout, stdin := os.Stdout, os.Stdin
+	os.Stdout, os.Stdin = w, null
+	child.Interact()
+	os.Stdout, os.Stdin = stdout, stdin
+
+	r.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var seen bytes.Buffer
+	chunk := make([]byte, 64)
+	for !strings.Contains(seen.String(), "bannertail") {
+		n, err := r.Read(chunk)
+		seen.Write(chunk[:n])
+		if err != nil {
+			t.Fatalf("expected all the output to be handed over, got %q: %v", seen.String(), err)
+		}
+	}
+}
+
+func TestSendBreak(t *testing.T) {
+	t.Logf("Testing SendBreak... ")
+	child, err := Spawn("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if err := child.SendBreak(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	child, err = SpawnNoPTY("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if err := child.SendBreak(10 * time.Millisecond); err != ErrNoPTY {
+		t.Fatalf("expected ErrNoPTY for a break on pipes, got %v", err)
+	}
+}
+
+func TestSubprocessSendConfirm(t *testing.T) {
+	t.Logf("Testing SendConfirm... ")
+	child, err := Spawn("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if err := child.SendConfirm("show version\n", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.ExpectTimeout("show version\r\n", 5*time.Second); err != nil {
+		t.Fatalf("expected cat's own output after the echo, got %v", err)
+	}
+}
+
+func TestSetWindowSizeAndEcho(t *testing.T) {
+	t.Logf("Testing SetWindowSize and SetEcho... ")
+	child, err := SpawnWithFallback(`sh -c "read line; stty size"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if err := child.SetWindowSize(33, 99); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.SetEcho(false); err != nil {
+		t.Fatal(err)
+	}
+	if child.echoing() {
+		t.Fatal("expected echo to be off")
+	}
+	if err := child.SendLine("go"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := child.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "33 99\r" {
+		t.Fatalf("expected the new size without the echo, got %q", line)
+	}
+
+	child, err = SpawnNoPTY("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if err := child.SetWindowSize(33, 99); err != ErrNoPTY {
+		t.Fatalf("expected ErrNoPTY, got %v", err)
+	}
+	if err := child.SetEcho(false); err != ErrNoPTY {
+		t.Fatalf("expected ErrNoPTY, got %v", err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	t.Logf("Testing Resize... ")
+	child, err := Spawn(`sh -c 'trap "stty size" WINCH; echo ready; while :; do sleep 0.05; done'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if err := child.ExpectTimeout("ready", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Resize(30, 90); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.ExpectTimeout("30 90", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// The child is signalled even if the size stays the same.
+	if err := child.Resize(30, 90); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.ExpectTimeout("30 90", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
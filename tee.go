@@ -0,0 +1,74 @@
+package gexpect
+
+import "sync"
+
+// Tee splits the output of expect into two ExpectIOs that each receive a
+// full copy of it, e.g. to wait for progress messages in one goroutine and
+// for completion in another without either consuming the other's output.
+// Output already buffered in expect, put back or read ahead, is passed on
+// first. From then on expect must not be read from anymore; a goroutine
+// reads its output and hands it to both branches as it arrives.
+//
+// Each branch queues what it hasn't read yet without limit, so that one
+// that isn't being read never holds up the other. A branch that is never
+// read keeps everything in memory until the output ends. Both branches
+// send to the child through expect, and start with default settings.
+func (expect *ExpectIO) Tee() (*ExpectIO, *ExpectIO) {
+	a, b := newTeeBranch(), newTeeBranch()
+	go func() {
+		chunk := make([]byte, minReadSize)
+		for {
+			n, err := expect.buf.Read(chunk)
+			a.write(chunk[:n], err)
+			b.write(chunk[:n], err)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return NewExpectIO(a, expect.buf), NewExpectIO(b, expect.buf)
+}
+
+// teeBranch queues the output for one side of a Tee.
+type teeBranch struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	data []byte
+	err  error
+}
+
+func newTeeBranch() *teeBranch {
+	t := new(teeBranch)
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+// write queues p, and err once all of it has been read.
+func (t *teeBranch) write(p []byte, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.data = append(t.data, p...)
+	if err != nil {
+		t.err = err
+	}
+	t.cond.Broadcast()
+}
+
+// Read waits for output and returns as much of it as fits in p.
+func (t *teeBranch) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(t.data) == 0 && t.err == nil {
+		t.cond.Wait()
+	}
+	if len(t.data) == 0 {
+		return 0, t.err
+	}
+	n := copy(p, t.data)
+	t.data = t.data[n:]
+	if len(t.data) == 0 {
+		// Let go of the memory of a burst that has been read.
+		t.data = nil
+	}
+	return n, nil
+}
@@ -0,0 +1,47 @@
+package gexpect
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTee(t *testing.T) {
+	t.Logf("Testing Tee...")
+	pipeReader, pipeWriter := io.Pipe()
+	var sent bytes.Buffer
+	exp := NewExpectIO(pipeReader, &sent)
+	go pipeWriter.Write([]byte("header\n"))
+	if err := exp.Expect("head"); err != nil {
+		t.Fatal(err)
+	}
+	progress, completion := exp.Tee()
+	go func() {
+		pipeWriter.Write([]byte("progress 50%\nprogress 100%\ndone\n"))
+		pipeWriter.Close()
+	}()
+
+	finishesWithin(t, 5*time.Second, func() {
+		// Completion is waited for first, while progress isn't read.
+		if err := completion.Expect("done"); err != nil {
+			t.Error(err)
+		}
+		for _, want := range []string{"er", "progress 50%", "progress 100%", "done"} {
+			line, err := progress.ReadLine()
+			if err != nil || line != want {
+				t.Errorf("Expected %q, got %q %v", want, line, err)
+			}
+		}
+		if _, err := progress.ReadLine(); err != io.EOF {
+			t.Errorf("Expected io.EOF, got %v", err)
+		}
+	})
+
+	if err := completion.Send("ack\n"); err != nil {
+		t.Fatal(err)
+	}
+	if sent.String() != "ack\n" {
+		t.Fatalf("Expected the branch to send through the original, got %q", sent.String())
+	}
+}
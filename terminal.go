@@ -0,0 +1,412 @@
+package gexpect
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var (
+	ErrNoTerminalEmulation = errors.New("terminal emulation is not enabled")
+)
+
+// ExpectScreen waits until regex matches the text rendered on the emulated
+// terminal, one line per row with trailing blanks removed, rather than the
+// raw output. Output is consumed while waiting. It requires terminal
+// emulation to be enabled.
+func (expect *ExpectIO) ExpectScreen(regex string) ([]string, error) {
+	if expect.buf.screen == nil {
+		return nil, ErrNoTerminalEmulation
+	}
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, err
+	}
+	chunk := make([]byte, 4096)
+	for {
+		text := strings.Join(expect.buf.screen.lines(), "\n")
+		if groups := re.FindStringSubmatch(text); groups != nil {
+			return groups, nil
+		}
+		// The screen is checked once more after the last read, which may
+		// return output along with the error.
+		if err != nil {
+			return nil, err
+		}
+		_, err = expect.buf.Read(chunk)
+	}
+}
+
+// Screen returns the text on the emulated terminal, one line per row with
+// trailing blanks removed. It is nil without terminal emulation.
+func (expect *ExpectIO) Screen() []string {
+	if expect.buf.screen == nil {
+		return nil
+	}
+	return expect.buf.screen.lines()
+}
+
+// Cursor returns the zero-based position of the emulated terminal's cursor.
+func (expect *ExpectIO) Cursor() (row, col int) {
+	if expect.buf.screen == nil {
+		return 0, 0
+	}
+	return expect.buf.screen.cursor()
+}
+
+// Key is the sequence a VT100-style terminal sends for a key, for SendKey.
+// Cursor keys are sent as in normal mode, which is what full-screen
+// programs accept unless they switched to application mode.
+type Key string
+
+const (
+	KeyEnter     Key = "\r"
+	KeyTab       Key = "\t"
+	KeyBackspace Key = "\x7f"
+	KeyEscape    Key = "\x1b"
+	KeyUp        Key = "\x1b[A"
+	KeyDown      Key = "\x1b[B"
+	KeyRight     Key = "\x1b[C"
+	KeyLeft      Key = "\x1b[D"
+	KeyHome      Key = "\x1b[H"
+	KeyEnd       Key = "\x1b[F"
+	KeyInsert    Key = "\x1b[2~"
+	KeyDelete    Key = "\x1b[3~"
+	KeyPageUp    Key = "\x1b[5~"
+	KeyPageDown  Key = "\x1b[6~"
+	KeyF1        Key = "\x1bOP"
+	KeyF2        Key = "\x1bOQ"
+	KeyF3        Key = "\x1bOR"
+	KeyF4        Key = "\x1bOS"
+	KeyF5        Key = "\x1b[15~"
+	KeyF6        Key = "\x1b[17~"
+	KeyF7        Key = "\x1b[18~"
+	KeyF8        Key = "\x1b[19~"
+	KeyF9        Key = "\x1b[20~"
+	KeyF10       Key = "\x1b[21~"
+	KeyF11       Key = "\x1b[23~"
+	KeyF12       Key = "\x1b[24~"
+)
+
+// SendKey sends the sequence for key, e.g. to move through the menus of a
+// full-screen program.
+func (expect *ExpectIO) SendKey(key Key) error {
+	return expect.Send(string(key))
+}
+
+func (expect *ExpectIO) enableScreen(rows, cols int) {
+	expect.buf.screen = newScreen(rows, cols)
+}
+
+// Parser states of screen.
+const (
+	stateGround = iota
+	stateEscape
+	stateCSI
+	stateOSC
+	stateCharset
+)
+
+// screen is a minimal VT100 emulator. It keeps the text a terminal would
+// display, following cursor movement and erasing, and ignores attributes
+// such as colours.
+type screen struct {
+	mu         sync.Mutex
+	rows, cols int
+	cells      [][]rune
+	row, col   int
+	savedRow   int
+	savedCol   int
+
+	state   int
+	params  []byte
+	partial []byte // incomplete UTF-8 sequence
+}
+
+func newScreen(rows, cols int) *screen {
+	s := &screen{rows: rows, cols: cols}
+	s.cells = make([][]rune, rows)
+	for i := range s.cells {
+		s.cells[i] = s.blankLine()
+	}
+	return s
+}
+
+func (s *screen) blankLine() []rune {
+	line := make([]rune, s.cols)
+	for i := range line {
+		line[i] = ' '
+	}
+	return line
+}
+
+// lines returns the rows of the screen with trailing blanks removed.
+func (s *screen) lines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lines := make([]string, s.rows)
+	for i, line := range s.cells {
+		lines[i] = strings.TrimRight(string(line), " ")
+	}
+	return lines
+}
+
+func (s *screen) cursor() (row, col int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.row, s.col
+}
+
+func (s *screen) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := append(s.partial, p...)
+	s.partial = nil
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			s.partial = append([]byte(nil), data...)
+			break
+		}
+		r, size := utf8.DecodeRune(data)
+		data = data[size:]
+		s.feed(r)
+	}
+	return len(p), nil
+}
+
+func (s *screen) feed(r rune) {
+	switch s.state {
+	case stateGround:
+		s.ground(r)
+	case stateEscape:
+		s.escape(r)
+	case stateCSI:
+		switch {
+		case r >= 0x30 && r <= 0x3f:
+			s.params = append(s.params, byte(r))
+		case r >= 0x40 && r <= 0x7e:
+			s.csi(r)
+			s.state = stateGround
+		}
+	case stateOSC:
+		switch r {
+		case 0x07:
+			s.state = stateGround
+		case 0x1b:
+			s.state = stateEscape
+		}
+	case stateCharset:
+		s.state = stateGround
+	}
+}
+
+func (s *screen) ground(r rune) {
+	switch r {
+	case 0x1b:
+		s.state = stateEscape
+	case '\r':
+		s.col = 0
+	case '\n', '\v', '\f':
+		s.lineFeed()
+	case '\b':
+		if s.col > 0 {
+			s.col--
+		}
+	case '\t':
+		s.col = (s.col/8 + 1) * 8
+		if s.col >= s.cols {
+			s.col = s.cols - 1
+		}
+	default:
+		if r < 0x20 || r == 0x7f {
+			return
+		}
+		if s.col >= s.cols {
+			s.col = 0
+			s.lineFeed()
+		}
+		s.cells[s.row][s.col] = r
+		s.col++
+	}
+}
+
+func (s *screen) escape(r rune) {
+	s.state = stateGround
+	switch r {
+	case '[':
+		s.state = stateCSI
+		s.params = s.params[:0]
+	case ']':
+		s.state = stateOSC
+	case '(', ')':
+		s.state = stateCharset
+	case 'D':
+		s.lineFeed()
+	case 'E':
+		s.col = 0
+		s.lineFeed()
+	case 'M':
+		if s.row > 0 {
+			s.row--
+		} else {
+			s.scrollDown(1)
+		}
+	case '7':
+		s.savedRow, s.savedCol = s.row, s.col
+	case '8':
+		s.row, s.col = s.savedRow, s.savedCol
+	case 'c':
+		s.erase(0, 0, s.rows-1, s.cols)
+		s.row, s.col = 0, 0
+	}
+}
+
+func (s *screen) csi(final rune) {
+	if len(s.params) > 0 && s.params[0] == '?' {
+		// Private modes, e.g. cursor visibility, don't affect the text.
+		return
+	}
+	var args []int
+	for _, field := range strings.Split(string(s.params), ";") {
+		n, _ := strconv.Atoi(field)
+		args = append(args, n)
+	}
+	// arg returns the i-th parameter, or def if it is missing or zero.
+	arg := func(i, def int) int {
+		if i < len(args) && args[i] > 0 {
+			return args[i]
+		}
+		return def
+	}
+	switch final {
+	case 'A':
+		s.moveTo(s.row-arg(0, 1), s.col)
+	case 'B':
+		s.moveTo(s.row+arg(0, 1), s.col)
+	case 'C':
+		s.moveTo(s.row, s.col+arg(0, 1))
+	case 'D':
+		s.moveTo(s.row, s.col-arg(0, 1))
+	case 'E':
+		s.moveTo(s.row+arg(0, 1), 0)
+	case 'F':
+		s.moveTo(s.row-arg(0, 1), 0)
+	case 'G':
+		s.moveTo(s.row, arg(0, 1)-1)
+	case 'd':
+		s.moveTo(arg(0, 1)-1, s.col)
+	case 'H', 'f':
+		s.moveTo(arg(0, 1)-1, arg(1, 1)-1)
+	case 'J':
+		switch arg(0, 0) {
+		case 0:
+			s.erase(s.row, s.col, s.rows-1, s.cols)
+		case 1:
+			s.erase(0, 0, s.row, s.col+1)
+		default:
+			s.erase(0, 0, s.rows-1, s.cols)
+		}
+	case 'K':
+		switch arg(0, 0) {
+		case 0:
+			s.erase(s.row, s.col, s.row, s.cols)
+		case 1:
+			s.erase(s.row, 0, s.row, s.col+1)
+		default:
+			s.erase(s.row, 0, s.row, s.cols)
+		}
+	case 'X':
+		s.erase(s.row, s.col, s.row, s.col+arg(0, 1))
+	case 'P':
+		line := s.cells[s.row]
+		n := minInt(arg(0, 1), s.cols-s.col)
+		copy(line[s.col:], line[s.col+n:])
+		s.erase(s.row, s.cols-n, s.row, s.cols)
+	case '@':
+		line := s.cells[s.row]
+		n := minInt(arg(0, 1), s.cols-s.col)
+		copy(line[s.col+n:], line[s.col:])
+		s.erase(s.row, s.col, s.row, s.col+n)
+	case 'L':
+		s.insertLines(s.row, arg(0, 1))
+	case 'M':
+		s.deleteLines(s.row, arg(0, 1))
+	case 'S':
+		s.deleteLines(0, arg(0, 1))
+	case 'T':
+		s.scrollDown(arg(0, 1))
+	case 's':
+		s.savedRow, s.savedCol = s.row, s.col
+	case 'u':
+		s.row, s.col = s.savedRow, s.savedCol
+	}
+}
+
+func (s *screen) moveTo(row, col int) {
+	s.row = maxInt(0, minInt(row, s.rows-1))
+	s.col = maxInt(0, minInt(col, s.cols-1))
+}
+
+// erase blanks the cells from (row1, col1) up to, but not including,
+// (row2, col2), wrapping at the end of each row.
+func (s *screen) erase(row1, col1, row2, col2 int) {
+	for row := row1; row <= row2; row++ {
+		from, to := 0, s.cols
+		if row == row1 {
+			from = col1
+		}
+		if row == row2 {
+			to = minInt(col2, s.cols)
+		}
+		for col := from; col < to; col++ {
+			s.cells[row][col] = ' '
+		}
+	}
+}
+
+func (s *screen) lineFeed() {
+	if s.row == s.rows-1 {
+		s.deleteLines(0, 1)
+	} else {
+		s.row++
+	}
+}
+
+// deleteLines removes n lines at row, scrolling up the ones below.
+func (s *screen) deleteLines(row, n int) {
+	n = minInt(n, s.rows-row)
+	copy(s.cells[row:], s.cells[row+n:])
+	for i := s.rows - n; i < s.rows; i++ {
+		s.cells[i] = s.blankLine()
+	}
+}
+
+// insertLines inserts n blank lines at row, scrolling down the ones below.
+func (s *screen) insertLines(row, n int) {
+	n = minInt(n, s.rows-row)
+	copy(s.cells[row+n:], s.cells[row:])
+	for i := row; i < row+n; i++ {
+		s.cells[i] = s.blankLine()
+	}
+}
+
+func (s *screen) scrollDown(n int) {
+	s.insertLines(0, n)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,85 @@
+package gexpect
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var screenTests = []struct {
+	desc   string
+	output string
+	lines  []string
+}{
+	{"plain lines", "foo\r\nbar", []string{"foo", "bar", ""}},
+	{"carriage return overwrites", "loading...\r\x1b[Kdone", []string{"done", "", ""}},
+	{"cursor positioning", "hello\x1b[1;1HJ\x1b[3;2Hx", []string{"Jello", "", " x"}},
+	{"relative moves", "abc\x1b[2DX\x1b[BY", []string{"aXc", "  Y", ""}},
+	{"clear screen", "foo\r\nbar\x1b[2J\x1b[HX", []string{"X", "", ""}},
+	{"wrap and scroll", "0123456789abc\r\nline\r\nlast", []string{"abc", "line", "last"}},
+	{"colours are ignored", "\x1b[1;31mred\x1b[0m \x1b]0;title\x07ok", []string{"red ok", "", ""}},
+	{"backspace", "ab\bc", []string{"ac", "", ""}},
+}
+
+func TestScreen(t *testing.T) {
+	t.Logf("Testing terminal emulation...")
+	for _, tt := range screenTests {
+		s := newScreen(3, 10)
+		// Write a byte at a time so that sequences are split.
+		for i := 0; i < len(tt.output); i++ {
+			s.Write([]byte{tt.output[i]})
+		}
+		if lines := s.lines(); strings.Join(lines, "|") != strings.Join(tt.lines, "|") {
+			t.Errorf("%s: expected %q, got %q", tt.desc, tt.lines, lines)
+		}
+	}
+}
+
+func TestExpectScreen(t *testing.T) {
+	t.Logf("Testing ExpectScreen...")
+	exp := mockExpectFromString("Progress: 10%\rProgress: 55%\rProgress: 100%\x1b[1;1H\x1b[2KStatus: Connected\r\n")
+	if _, err := exp.ExpectScreen(`Connected`); err != ErrNoTerminalEmulation {
+		t.Fatalf("expected ErrNoTerminalEmulation, got %v", err)
+	}
+	exp.enableScreen(24, 80)
+	groups, err := exp.ExpectScreen(`(?m)^Status: (\w+)$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[1] != "Connected" {
+		t.Fatalf("expected 'Connected', got %q", groups[1])
+	}
+}
+
+func TestScreenAndCursor(t *testing.T) {
+	t.Logf("Testing Screen and Cursor...")
+	exp := mockExpectFromString("\x1b[2J\x1b[1;1HMenu\x1b[3;3HConnected\x1b[2;5H> ")
+	if exp.Screen() != nil {
+		t.Fatal("expected no screen without terminal emulation")
+	}
+	exp.enableScreen(4, 20)
+	if err := exp.Expect("> "); err != nil {
+		t.Fatal(err)
+	}
+	screen := exp.Screen()
+	if len(screen) != 4 || screen[0] != "Menu" || screen[1] != "    >" || screen[2] != "  Connected" {
+		t.Fatalf("unexpected screen %q", screen)
+	}
+	if row, col := exp.Cursor(); row != 1 || col != 6 {
+		t.Fatalf("expected the cursor at 1,6, got %d,%d", row, col)
+	}
+}
+
+func TestSendKey(t *testing.T) {
+	t.Logf("Testing SendKey...")
+	var sent bytes.Buffer
+	exp := NewExpectIO(strings.NewReader(""), &sent)
+	for _, key := range []Key{KeyDown, KeyDown, KeyEnter, KeyF10} {
+		if err := exp.SendKey(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sent.String() != "\x1b[B\x1b[B\r\x1b[21~" {
+		t.Fatalf("expected the key sequences, got %q", sent.String())
+	}
+}
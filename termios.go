@@ -0,0 +1,78 @@
+// +build !windows
+
+package gexpect
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/kr/pty"
+)
+
+func getTermios(f *os.File) (*syscall.Termios, error) {
+	var termios syscall.Termios
+	if err := ioctl(f, ioctlReadTermios, unsafe.Pointer(&termios)); err != nil {
+		return nil, err
+	}
+	return &termios, nil
+}
+
+func setTermios(f *os.File, termios *syscall.Termios) error {
+	return ioctl(f, ioctlWriteTermios, unsafe.Pointer(termios))
+}
+
+func setWinsize(f *os.File, ws *pty.Winsize) error {
+	return ioctl(f, syscall.TIOCSWINSZ, unsafe.Pointer(ws))
+}
+
+// ioctl goes through f's raw connection rather than f.Fd, which would put
+// f back into blocking mode where read deadlines don't work.
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	return control(f, func(fd uintptr) syscall.Errno {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+		return errno
+	})
+}
+
+// ioctlInt is ioctl for requests taking an integer rather than a pointer.
+func ioctlInt(f *os.File, req, arg uintptr) error {
+	return control(f, func(fd uintptr) syscall.Errno {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+		return errno
+	})
+}
+
+func control(f *os.File, fn func(fd uintptr) syscall.Errno) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		errno = fn(fd)
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// pollable returns a non-blocking duplicate of f, which the runtime poller
+// handles so that read deadlines work, and closes f.
+func pollable(f *os.File) (*os.File, error) {
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fd)
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
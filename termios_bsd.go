@@ -0,0 +1,65 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package gexpect
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+const (
+	ioctlReadTermios  = syscall.TIOCGETA
+	ioctlWriteTermios = syscall.TIOCSETA
+)
+
+// tcdrain waits until everything written to f has been transmitted.
+func tcdrain(f *os.File) error {
+	return ioctlInt(f, syscall.TIOCDRAIN, 0)
+}
+
+// setSpeed sets the baud rate of termios. The speed fields differ in type
+// between the BSDs, hence the constants.
+func setSpeed(termios *syscall.Termios, baud int) error {
+	switch baud {
+	case 50:
+		termios.Ispeed, termios.Ospeed = syscall.B50, syscall.B50
+	case 75:
+		termios.Ispeed, termios.Ospeed = syscall.B75, syscall.B75
+	case 110:
+		termios.Ispeed, termios.Ospeed = syscall.B110, syscall.B110
+	case 134:
+		termios.Ispeed, termios.Ospeed = syscall.B134, syscall.B134
+	case 150:
+		termios.Ispeed, termios.Ospeed = syscall.B150, syscall.B150
+	case 200:
+		termios.Ispeed, termios.Ospeed = syscall.B200, syscall.B200
+	case 300:
+		termios.Ispeed, termios.Ospeed = syscall.B300, syscall.B300
+	case 600:
+		termios.Ispeed, termios.Ospeed = syscall.B600, syscall.B600
+	case 1200:
+		termios.Ispeed, termios.Ospeed = syscall.B1200, syscall.B1200
+	case 1800:
+		termios.Ispeed, termios.Ospeed = syscall.B1800, syscall.B1800
+	case 2400:
+		termios.Ispeed, termios.Ospeed = syscall.B2400, syscall.B2400
+	case 4800:
+		termios.Ispeed, termios.Ospeed = syscall.B4800, syscall.B4800
+	case 9600:
+		termios.Ispeed, termios.Ospeed = syscall.B9600, syscall.B9600
+	case 19200:
+		termios.Ispeed, termios.Ospeed = syscall.B19200, syscall.B19200
+	case 38400:
+		termios.Ispeed, termios.Ospeed = syscall.B38400, syscall.B38400
+	case 57600:
+		termios.Ispeed, termios.Ospeed = syscall.B57600, syscall.B57600
+	case 115200:
+		termios.Ispeed, termios.Ospeed = syscall.B115200, syscall.B115200
+	case 230400:
+		termios.Ispeed, termios.Ospeed = syscall.B230400, syscall.B230400
+	default:
+		return fmt.Errorf("gexpect: unsupported baud rate %d", baud)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package gexpect
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+const (
+	ioctlReadTermios  = syscall.TCGETS
+	ioctlWriteTermios = syscall.TCSETS
+)
+
+// tcdrain waits until everything written to f has been transmitted.
+func tcdrain(f *os.File) error {
+	return ioctlInt(f, tcsbrk(), 1)
+}
+
+// tcsbrk returns the TCSBRK request, which package syscall lacks.
+func tcsbrk() uintptr {
+	switch runtime.GOARCH {
+	case "mips", "mipsle", "mips64", "mips64le":
+		return 0x5405
+	case "ppc64", "ppc64le":
+		return 0x2000741d
+	}
+	return 0x5409
+}
+
+var speeds = map[int]uint32{
+	50:      syscall.B50,
+	75:      syscall.B75,
+	110:     syscall.B110,
+	134:     syscall.B134,
+	150:     syscall.B150,
+	200:     syscall.B200,
+	300:     syscall.B300,
+	600:     syscall.B600,
+	1200:    syscall.B1200,
+	1800:    syscall.B1800,
+	2400:    syscall.B2400,
+	4800:    syscall.B4800,
+	9600:    syscall.B9600,
+	19200:   syscall.B19200,
+	38400:   syscall.B38400,
+	57600:   syscall.B57600,
+	115200:  syscall.B115200,
+	230400:  syscall.B230400,
+	460800:  syscall.B460800,
+	500000:  syscall.B500000,
+	576000:  syscall.B576000,
+	921600:  syscall.B921600,
+	1000000: syscall.B1000000,
+	1152000: syscall.B1152000,
+	1500000: syscall.B1500000,
+	2000000: syscall.B2000000,
+	2500000: syscall.B2500000,
+	3000000: syscall.B3000000,
+	3500000: syscall.B3500000,
+	4000000: syscall.B4000000,
+}
+
+// setSpeed sets the baud rate of termios, which Linux keeps in Cflag.
+func setSpeed(termios *syscall.Termios, baud int) error {
+	speed, ok := speeds[baud]
+	if !ok {
+		return fmt.Errorf("gexpect: unsupported baud rate %d", baud)
+	}
+	cbaud := uint32(0x100f)
+	if runtime.GOARCH == "ppc64" || runtime.GOARCH == "ppc64le" {
+		cbaud = 0xff
+	}
+	termios.Cflag = termios.Cflag&^cbaud | speed
+	return nil
+}
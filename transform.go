@@ -0,0 +1,46 @@
+package gexpect
+
+import "io"
+
+// WithTransform passes everything read from the child through fn before it
+// is matched against, e.g. to decode a payload wrapped in a line protocol.
+// Transforms stack: each one added gets the output of those before it, and
+// all of them come after the decoder of SetDecoder and before the prefix
+// stripping of SetLinePrefixStrip. Loggers and mirrors still get the raw
+// output. fn sees the output in chunks as it is read, which needn't line
+// up with lines or records, so a transform that needs whole ones must hold
+// back the rest itself, copying it. Output already read ahead is kept as
+// it was. It returns expect, so that calls can be chained.
+func (expect *ExpectIO) WithTransform(fn func([]byte) []byte) *ExpectIO {
+	expect.buf.transforms = append(expect.buf.transforms, fn)
+	expect.buf.resetReader()
+	return expect
+}
+
+// funcTransformer applies fn to what is read from r.
+type funcTransformer struct {
+	r     io.Reader
+	fn    func([]byte) []byte
+	chunk []byte
+	out   []byte
+	err   error
+}
+
+func (t *funcTransformer) Read(p []byte) (int, error) {
+	for len(t.out) == 0 && t.err == nil {
+		if len(t.chunk) < len(p) {
+			t.chunk = make([]byte, len(p))
+		}
+		n, err := t.r.Read(t.chunk[:len(p)])
+		if n > 0 {
+			t.out = t.fn(t.chunk[:n])
+		}
+		t.err = err
+	}
+	n := copy(p, t.out)
+	t.out = t.out[n:]
+	if len(t.out) == 0 && t.err != nil {
+		return n, t.err
+	}
+	return n, nil
+}
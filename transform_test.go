@@ -0,0 +1,56 @@
+package gexpect
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// base64Lines decodes each whole line of base64, holding back the rest.
+func base64Lines() func([]byte) []byte {
+	var partial []byte
+	return func(data []byte) []byte {
+		partial = append(partial, data...)
+		var out []byte
+		for {
+			i := bytes.IndexByte(partial, '\n')
+			if i < 0 {
+				return out
+			}
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(partial[:i])))
+			if err != nil {
+				decoded = []byte("?")
+			}
+			out = append(append(out, decoded...), '\n')
+			partial = partial[i+1:]
+		}
+	}
+}
+
+func TestWithTransform(t *testing.T) {
+	t.Logf("Testing WithTransform...")
+	var input string
+	for _, line := range []string{"status: booting", "status: ready"} {
+		input += base64.StdEncoding.EncodeToString([]byte(line)) + "\r\n"
+	}
+	var raw bytes.Buffer
+	exp := NewExpectIO(iotest.OneByteReader(strings.NewReader(input)), ioutil.Discard)
+	exp.SetMirror(&raw)
+	exp.WithTransform(base64Lines()).WithTransform(bytes.ToUpper)
+	groups, err := exp.ExpectRegexFind(`STATUS: (\w+)\n`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[1] != "BOOTING" {
+		t.Fatalf("expected the decoded and upper-cased output, got %q", groups)
+	}
+	if err := exp.Expect("STATUS: READY"); err != nil {
+		t.Fatal(err)
+	}
+	if raw.String() != input {
+		t.Fatalf("expected the mirror to get the raw output, got %q", raw.String())
+	}
+}